@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+const modeRule = "rule"
+const modeAlias = "alias"
+
+const aliasPrefix = "creamy_"
+
+// aliases may be at most 31 characters of letters, digits and underscores
+const aliasMaxLength = 31
+
+// aliasName returns the alias holding the sources that chose gateway
+func aliasName(gateway string) string {
+	name := []rune(aliasPrefix)
+	for _, r := range gateway {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			name = append(name, r)
+		} else {
+			name = append(name, '_')
+		}
+	}
+
+	if len(name) > aliasMaxLength {
+		name = name[:aliasMaxLength]
+	}
+
+	return string(name)
+}
+
+func aliasDescription(gw gateway) string {
+	return dork + " sources that chose \"" + gw.Label + "\" (" + gw.Name + ")"
+}
+
+func aliasRuleDescription(gw gateway) string {
+	return dork + " members of " + aliasName(gw.Name) + " chose \"" + gw.Label + "\" (" + gw.Name + ")"
+}
+
+type familyGateway struct {
+	family  string
+	gateway string
+}
+
+// aliasRuleFamilies lists the rules an alias of gw needs: aliases can
+// hold addresses of both families, but a rule routes one family
+// unless the gateway handles both
+func aliasRuleFamilies(gw gateway) []familyGateway {
+	switch gw.Name6 {
+	case "":
+		return []familyGateway{{remote.FamilyIPv4, gw.Name}}
+	case gw.Name:
+		return []familyGateway{{remote.FamilyDual, gw.Name}}
+	}
+
+	return []familyGateway{{remote.FamilyIPv4, gw.Name}, {remote.FamilyIPv6, gw.Name6}}
+}
+
+func getAliasClient() (remote.AliasClient, error) {
+	aliasClient, ok := client.(remote.AliasClient)
+	if !ok {
+		return nil, errors.New("remote does not support aliases")
+	}
+
+	return aliasClient, nil
+}
+
+// managedAliases maps alias names to the configured gateway they belong to
+func managedAliases() map[string]gateway {
+	managed := make(map[string]gateway, len(cfg.Gateways))
+	for _, gw := range cfg.Gateways {
+		managed[aliasName(gw.Name)] = gw
+	}
+	return managed
+}
+
+// sourceAlias returns the managed alias that contains source, if any
+func sourceAlias(aliases []remote.Alias, source string) remote.Alias {
+	managed := managedAliases()
+
+	for _, alias := range aliases {
+		if _, found := managed[alias.Name()]; !found {
+			continue
+		}
+
+		for _, address := range alias.Addresses() {
+			if address == source {
+				return alias
+			}
+		}
+	}
+
+	return nil
+}
+
+func withAddress(addresses []string, address string) []string {
+	updated := make([]string, 0, len(addresses)+1)
+	for _, existing := range addresses {
+		if existing == address {
+			return addresses
+		}
+		updated = append(updated, existing)
+	}
+
+	return append(updated, address)
+}
+
+func withAddresses(addresses []string, added []string) []string {
+	for _, address := range added {
+		addresses = withAddress(addresses, address)
+	}
+
+	return addresses
+}
+
+func withoutAddresses(addresses []string, removed []string) []string {
+	updated := make([]string, 0, len(addresses))
+	for _, existing := range addresses {
+		keep := true
+		for _, address := range removed {
+			if existing == address {
+				keep = false
+				break
+			}
+		}
+
+		if keep {
+			updated = append(updated, existing)
+		}
+	}
+
+	return updated
+}
+
+// containsAny reports whether any of the addresses is in alias
+func containsAny(alias remote.Alias, addresses []string) bool {
+	return len(withoutAddresses(alias.Addresses(), addresses)) != len(alias.Addresses())
+}
+
+// setupAliases makes sure every configured gateway has an alias, and
+// every gateway offered on ni a rule that routes the alias members
+// through it. Hosts with a per-source dork rule for all their traffic
+// are then moved into the matching alias and their rule is removed.
+// Alias mode cannot express the other rules, so they are left alone.
+func setupAliases(ctx context.Context, ni networkInterface) error {
+	iface := ni.Name
+
+	ctx, cancel, err := lockState(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlockState()
+	defer cancel()
+	defer invalidateRules(iface)
+
+	aliasClient, err := getAliasClient()
+	if err != nil {
+		return err
+	}
+
+	aliases, err := aliasClient.ListAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	existingAliases := make(map[string]remote.Alias, len(aliases))
+	for _, alias := range aliases {
+		existingAliases[alias.Name()] = alias
+	}
+
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	managed := managedAliases()
+
+	// sources of per-source rules, by the alias they should move to
+	migrations := map[string][]string{}
+	migratedRules := []remote.FirewallRule{}
+
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Description(), dork) {
+			continue
+		}
+
+		if _, isAliasRule := managed[rule.Source()]; isAliasRule {
+			continue
+		}
+
+		if net.ParseIP(rule.Source()) == nil {
+			log.Println("not migrating rule for subnet or alias", rule.Source())
+			continue
+		}
+
+		if dest := destinationOf(rule); dest != catchAll {
+			log.Println("not migrating rule for", rule.Source(), "to destination", dest.Name)
+			continue
+		}
+
+		if until, _, timed := parseExpiry(rule.Description()); timed {
+			log.Println("not migrating rule for", rule.Source(), "expiring at", until)
+			continue
+		}
+
+		// IPv6 rules use the IPv6 name of the gateway
+		gw, err := getGatewayByName(rule.Gateway())
+		if err != nil {
+			log.Println("not migrating rule for", rule.Source(), "with unknown gateway", rule.Gateway())
+			continue
+		}
+
+		alias := aliasName(gw.Name)
+
+		migrations[alias] = append(migrations[alias], rule.Source())
+		migratedRules = append(migratedRules, rule)
+	}
+
+	for _, gw := range cfg.Gateways {
+		name := aliasName(gw.Name)
+
+		addresses := []string{}
+		if alias, found := existingAliases[name]; found {
+			addresses = alias.Addresses()
+		}
+
+		for _, source := range migrations[name] {
+			addresses = withAddress(addresses, source)
+		}
+
+		if _, found := existingAliases[name]; !found || len(migrations[name]) > 0 {
+			log.Println("saving alias", name, "with", len(addresses), "members")
+			_, err = aliasClient.UpdateAlias(ctx, name, aliasDescription(gw), addresses)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !ni.offers(gw) {
+			continue
+		}
+
+		for _, needed := range aliasRuleFamilies(gw) {
+			hasRule := false
+			for _, rule := range rules {
+				if rule.Source() == name && rule.Family() == needed.family && strings.HasPrefix(rule.Description(), dork) {
+					hasRule = true
+					break
+				}
+			}
+
+			if !hasRule {
+				log.Println("adding", needed.family, "rule for alias", name)
+				_, err = client.AddRule(ctx, iface, needed.family, name, "*", "*", "*", needed.gateway, aliasRuleDescription(gw))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(migratedRules) == 0 {
+		return nil
+	}
+
+	// only drop the per-source rules once their sources are in an alias.
+	// The alias rules added above moved them on remotes that identify
+	// rules by position, so they are found again and deleted bottom-up.
+	migrated := make(map[string]bool, len(migratedRules))
+	for _, rule := range migratedRules {
+		migrated[ruleSlot(rule)+"|"+rule.Gateway()+"|"+rule.Description()] = true
+	}
+
+	rules, err = client.ListRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if !migrated[ruleSlot(rule)+"|"+rule.Gateway()+"|"+rule.Description()] {
+			continue
+		}
+
+		log.Println("removing migrated rule for", rule.Source())
+		err = rule.Delete(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getActiveAliasRule(ctx context.Context, iface, source string) (remote.FirewallRule, error) {
+	if _, err := getAliasClient(); err != nil {
+		return nil, err
+	}
+
+	aliases, err := listAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	alias := sourceAlias(aliases, source)
+	if alias == nil {
+		return nil, nil
+	}
+
+	rules, _, err := cachedRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if rule.Source() == alias.Name() && strings.HasPrefix(rule.Description(), dork) {
+			return rule, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// restoreAliases undoes a failed alias switch: sources are taken back
+// out of the alias they were being added to, and removed maps the
+// aliases they were taken out of to the sources to return to them.
+// Like restoreRule, it gets its own deadline but stays in its batch.
+func restoreAliases(ctx context.Context, sources []string, target *gateway, removed map[string][]string) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.RemoteTimeout)
+	defer cancel()
+
+	aliasClient, err := getAliasClient()
+	if err != nil {
+		return err
+	}
+
+	aliases, err := aliasClient.ListAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	managed := managedAliases()
+
+	for _, alias := range aliases {
+		if target != nil && alias.Name() == aliasName(target.Name) {
+			_, err = aliasClient.UpdateAlias(ctx, alias.Name(), aliasDescription(*target), withoutAddresses(alias.Addresses(), sources))
+			if err != nil {
+				return err
+			}
+		}
+
+		if gw, found := managed[alias.Name()]; found && len(removed[alias.Name()]) > 0 {
+			_, err = aliasClient.UpdateAlias(ctx, alias.Name(), aliasDescription(gw), withAddresses(alias.Addresses(), removed[alias.Name()]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setAliasGatewayLocked moves sources, the addresses of one host, into
+// the alias of gateway. They are added to the new alias before they
+// leave the old ones, so there is never a moment where they have no
+// choice at all. The caller must hold the state lock.
+func setAliasGatewayLocked(ctx context.Context, sources []string, gatewayName string) error {
+	aliasClient, err := getAliasClient()
+	if err != nil {
+		return err
+	}
+
+	aliases, err := aliasClient.ListAliases(ctx)
+	if err != nil {
+		return err
+	}
+
+	managed := managedAliases()
+
+	var previous *gateway
+	if previousAlias := sourceAlias(aliases, sources[0]); previousAlias != nil {
+		gw := managed[previousAlias.Name()]
+		previous = &gw
+	}
+
+	var target *gateway
+	if gatewayName != deleteDork {
+		gw, found := managed[aliasName(gatewayName)]
+		if !found {
+			return errors.New("gateway not found")
+		}
+		target = &gw
+	}
+
+	// nothing to change:
+	if previous == nil && target == nil {
+		return nil
+	}
+
+	// sources taken out of each alias, to put back if a later step fails
+	removed := map[string][]string{}
+	onRollback(ctx, func(ctx context.Context) error {
+		return restoreAliases(ctx, sources, target, removed)
+	})
+
+	if target != nil {
+		var targetAlias remote.Alias
+		for _, alias := range aliases {
+			if alias.Name() == aliasName(target.Name) {
+				targetAlias = alias
+			}
+		}
+
+		targetAddresses := []string{}
+		if targetAlias != nil {
+			targetAddresses = targetAlias.Addresses()
+		}
+
+		if updated := withAddresses(targetAddresses, sources); targetAlias == nil || len(updated) != len(targetAddresses) {
+			reportProgress(ctx, jobAdding)
+			_, err = aliasClient.UpdateAlias(ctx, aliasName(target.Name), aliasDescription(*target), updated)
+			if err != nil {
+				return &switchError{err, restoreAliases(ctx, sources, target, nil)}
+			}
+		}
+	}
+
+	for _, alias := range aliases {
+		gw, found := managed[alias.Name()]
+		if !found || (target != nil && gw.Name == target.Name) || !containsAny(alias, sources) {
+			continue
+		}
+
+		for _, source := range sources {
+			if containsAny(alias, []string{source}) {
+				removed[alias.Name()] = append(removed[alias.Name()], source)
+			}
+		}
+
+		reportProgress(ctx, jobDeleting)
+		_, err = aliasClient.UpdateAlias(ctx, alias.Name(), aliasDescription(gw), withoutAddresses(alias.Addresses(), sources))
+		if err != nil {
+			return &switchError{err, restoreAliases(ctx, sources, target, removed)}
+		}
+	}
+
+	// sources that stayed put keep their states
+	if target != nil && (previous == nil || previous.Name != target.Name) {
+		previousGateway := ""
+		if previous != nil {
+			previousGateway = previous.Name
+		}
+
+		for _, source := range sources {
+			resetStates(ctx, source, previousGateway, target.Name)
+		}
+	}
+
+	return nil
+}
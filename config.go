@@ -1,25 +1,158 @@
 package main
 
+import (
+	"net"
+	"time"
+)
+
 type gateway struct {
 	Name       string
 	Label      string
 	StatusName string
+	Table      string
+
+	// Name6 is the IPv6 counterpart of Name, empty if there is none.
+	// If it equals Name, the gateway handles both families.
+	Name6       string
+	StatusName6 string
+
+	// KillStates drops the states of sources that switch to this
+	// gateway, so their open connections move too
+	KillStates bool
+	// Interface is the WAN the gateway is on, states through it are
+	// the ones killed when sources switch away, where the remote can tell
+	Interface string
+}
+
+// networkInterface is a remote interface the picker serves,
+// picked for each request by the subnet of its source
+type networkInterface struct {
+	Name string
+
+	// Subnets are loaded from the remote if none are configured
+	Subnets []*net.IPNet
+
+	// Gateways users on this interface may choose
+	Gateways []gateway
+}
+
+// destination is a catalog entry users may route through another
+// gateway than the rest of their traffic
+type destination struct {
+	Name  string
+	Label string
+
+	// Address is a host, subnet or alias on the remote
+	Address string
+	// Protocol and Port are "*" for any
+	Protocol string
+	Port     string
+}
+
+// catchAll is the destination of a source's own gateway choice
+var catchAll = destination{
+	Name:     "*",
+	Label:    "everything else",
+	Address:  "*",
+	Protocol: "*",
+	Port:     "*",
 }
 
 type config struct {
 	Debug bool `env:"CREAMY_GATEWAY_DEBUG"`
 
+	// Mode is "rule" for one rule per source, or "alias" for
+	// one rule per gateway with an alias of sources
+	Mode string `env:"CREAMY_GATEWAY_MODE" envDefault:"rule"`
+
+	RemoteType      string `env:"CREAMY_GATEWAY_REMOTE_TYPE" envDefault:"sensemilla"`
 	RemoteHost      string `env:"CREAMY_GATEWAY_REMOTE_HOST"`
 	RemoteUsername  string `env:"CREAMY_GATEWAY_REMOTE_USERNAME"`
 	RemotePassword  string `env:"CREAMY_GATEWAY_REMOTE_PASSWORD"`
 	RemoteInterface string `env:"CREAMY_GATEWAY_REMOTE_INTERFACE"`
 
+	// RemoteInterfaces replaces RemoteInterface to serve several interfaces.
+	// InterfaceSubnets and InterfaceGateways are parallel lists of
+	// space-separated subnets and gateway names, empty for all of them
+	// or, for subnets, to load them from the remote.
+	RemoteInterfaces  []string `env:"CREAMY_GATEWAY_REMOTE_INTERFACES" envSeparator:","`
+	InterfaceSubnets  []string `env:"CREAMY_GATEWAY_INTERFACE_SUBNETS" envSeparator:","`
+	InterfaceGateways []string `env:"CREAMY_GATEWAY_INTERFACE_GATEWAYS" envSeparator:","`
+
+	Interfaces []networkInterface
+
+	// RemoteHosts replaces RemoteHost to manage an HA group like a CARP
+	// pair. HAMode is "sync" to write to the master and have it sync its
+	// config, or "write-all" to write to every node.
+	RemoteHosts []string `env:"CREAMY_GATEWAY_REMOTE_HOSTS" envSeparator:","`
+	HAMode      string   `env:"CREAMY_GATEWAY_HA_MODE" envDefault:"sync"`
+
+	// RemoteTimeout limits each operation against the remote,
+	// not counting time spent waiting for other operations
+	RemoteTimeout time.Duration `env:"CREAMY_GATEWAY_REMOTE_TIMEOUT" envDefault:"30s"`
+
+	// ReadSessions is how many extra sessions reads may log in with,
+	// to run in parallel with each other and with writes. Idle ones
+	// are dropped after ReadSessionIdleTimeout. 0, the default, makes
+	// reads share the session of writes, as every extra session is
+	// another login on the firewall.
+	ReadSessions           int           `env:"CREAMY_GATEWAY_READ_SESSIONS" envDefault:"0"`
+	ReadSessionIdleTimeout time.Duration `env:"CREAMY_GATEWAY_READ_SESSION_IDLE_TIMEOUT" envDefault:"5m"`
+
+	// PollInterval is how often gateway status and rules are listed
+	// for page views, which are served from what was listed last.
+	// 0 lists them live on every view.
+	PollInterval time.Duration `env:"CREAMY_GATEWAY_POLL_INTERVAL" envDefault:"10s"`
+
+	// ReconcileInterval is how often duplicate rules and rules through
+	// gateways no longer configured are removed, 0 to only do so on request
+	ReconcileInterval time.Duration `env:"CREAMY_GATEWAY_RECONCILE_INTERVAL" envDefault:"15m"`
+
+	RemoteRequestTimeout     time.Duration `env:"CREAMY_GATEWAY_REMOTE_REQUEST_TIMEOUT" envDefault:"2m"`
+	RemoteIdleTimeout        time.Duration `env:"CREAMY_GATEWAY_REMOTE_IDLE_TIMEOUT" envDefault:"90s"`
+	RemoteDisableKeepAlives  bool          `env:"CREAMY_GATEWAY_REMOTE_DISABLE_KEEPALIVES"`
+	RemoteProxy              string        `env:"CREAMY_GATEWAY_REMOTE_PROXY"`
+	RemoteInsecureSkipVerify bool          `env:"CREAMY_GATEWAY_REMOTE_INSECURE_SKIP_VERIFY"`
+
+	// SensemillaProfiles is a JSON file of selector profiles for firmware
+	// versions whose markup differs from the default profile
+	SensemillaProfiles string `env:"CREAMY_GATEWAY_SENSEMILLA_PROFILES"`
+
+	LinuxMode         string `env:"CREAMY_GATEWAY_LINUX_MODE" envDefault:"iprule"`
+	LinuxRulePriority int    `env:"CREAMY_GATEWAY_LINUX_RULE_PRIORITY" envDefault:"10000"`
+
+	// LinuxStateFile keeps the descriptions of ip rules, which cannot
+	// carry one themselves, across restarts
+	LinuxStateFile string `env:"CREAMY_GATEWAY_LINUX_STATE_FILE" envDefault:"/var/lib/creamy-gateway/linux-rules.json"`
+
 	GatewayNames       []string `env:"CREAMY_GATEWAY_GATEWAYS" envSeparator:","`
 	GatewayLabels      []string `env:"CREAMY_GATEWAY_GATEWAY_LABELS" envSeparator:","`
 	GatewayStatusNames []string `env:"CREAMY_GATEWAY_GATEWAY_STATUS_NAMES" envSeparator:","`
+	GatewayTables      []string `env:"CREAMY_GATEWAY_GATEWAY_TABLES" envSeparator:","`
+
+	GatewayNames6       []string `env:"CREAMY_GATEWAY_GATEWAYS_IPV6" envSeparator:","`
+	GatewayStatusNames6 []string `env:"CREAMY_GATEWAY_GATEWAY_STATUS_NAMES_IPV6" envSeparator:","`
+
+	GatewayKillStates []bool   `env:"CREAMY_GATEWAY_GATEWAY_KILL_STATES" envSeparator:","`
+	GatewayInterfaces []string `env:"CREAMY_GATEWAY_GATEWAY_INTERFACES" envSeparator:","`
 
 	Gateways []gateway
 
+	DestinationNames     []string `env:"CREAMY_GATEWAY_DESTINATIONS" envSeparator:","`
+	DestinationLabels    []string `env:"CREAMY_GATEWAY_DESTINATION_LABELS" envSeparator:","`
+	DestinationAddresses []string `env:"CREAMY_GATEWAY_DESTINATION_ADDRESSES" envSeparator:","`
+	DestinationProtocols []string `env:"CREAMY_GATEWAY_DESTINATION_PROTOCOLS" envSeparator:","`
+	DestinationPorts     []string `env:"CREAMY_GATEWAY_DESTINATION_PORTS" envSeparator:","`
+
+	Destinations []destination
+
+	RulePlacement       string `env:"CREAMY_GATEWAY_RULE_PLACEMENT" envDefault:"after-default-gateway"`
+	RulePlacementMarker string `env:"CREAMY_GATEWAY_RULE_PLACEMENT_MARKER"`
+
+	// AdminNetworks may choose gateways for other sources,
+	// like whole subnets or aliases
+	AdminNetworks []string `env:"CREAMY_GATEWAY_ADMIN_NETWORKS" envSeparator:","`
+
 	TrustForwardedHeaders bool   `env:"CREAMY_GATEWAY_TRUST_FORWARDED_HEADERS"`
 	Port                  string `env:"CREAMY_GATEWAY_PORT" envDefault:"5000"`
 }
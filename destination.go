@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// matches reports whether rule sends traffic to dest
+func (dest destination) matches(rule remote.FirewallRule) bool {
+	return rule.Destination() == dest.Address && rule.Protocol() == dest.Protocol && rule.Port() == dest.Port
+}
+
+func sameDestination(a, b remote.FirewallRule) bool {
+	return a.Destination() == b.Destination() && a.Protocol() == b.Protocol() && a.Port() == b.Port()
+}
+
+// getDestinationByName finds a destination in the catalog,
+// an empty name or "*" is the catch-all
+func getDestinationByName(destinationName string) (*destination, error) {
+	if destinationName == "" || destinationName == catchAll.Name {
+		dest := catchAll
+		return &dest, nil
+	}
+
+	for _, dest := range cfg.Destinations {
+		if dest.Name == destinationName {
+			return &dest, nil
+		}
+	}
+
+	return nil, errors.New("destination not found")
+}
+
+// destinationOf finds the catalog entry rule sends traffic to.
+// Rules for destinations since removed from the catalog get an entry
+// named after their address, so they can still be listed and removed.
+func destinationOf(rule remote.FirewallRule) destination {
+	if catchAll.matches(rule) {
+		return catchAll
+	}
+
+	for _, dest := range cfg.Destinations {
+		if dest.matches(rule) {
+			return dest
+		}
+	}
+
+	return destination{
+		Name:     rule.Destination(),
+		Label:    rule.Destination(),
+		Address:  rule.Destination(),
+		Protocol: rule.Protocol(),
+		Port:     rule.Port(),
+	}
+}
+
+func containsSource(sources []string, source string) bool {
+	for _, candidate := range sources {
+		if candidate == source {
+			return true
+		}
+	}
+
+	return false
+}
+
+// choice is a gateway chosen by a source for one destination
+type choice struct {
+	Destination      string `json:"destination"`
+	DestinationLabel string `json:"destination_label"`
+	Gateway          string `json:"gateway"`
+	GatewayLabel     string `json:"gateway_label"`
+	// Families lists the address families the choice has rules for
+	Families []string `json:"families"`
+	// Expires is when a time-limited choice is reverted
+	Expires   *time.Time `json:"expires,omitempty"`
+	ExpiresIn string     `json:"expires_in,omitempty"`
+}
+
+// listChoices returns the gateways chosen by source's host,
+// one entry per destination with the catch-all first
+func listChoices(ctx context.Context, iface, source string) ([]choice, error) {
+	if cfg.Mode == modeAlias {
+		return listAliasChoices(ctx, iface, source)
+	}
+
+	sources := dualStackSources(ctx, source)
+
+	rules, _, err := cachedRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	choices := []choice{}
+	indexes := map[string]int{}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Description(), dork) || !containsSource(sources, rule.Source()) {
+			continue
+		}
+
+		dest := destinationOf(rule)
+		if index, found := indexes[dest.Name]; found {
+			choices[index].Families = append(choices[index].Families, rule.Family())
+			continue
+		}
+
+		chosen := choice{
+			Destination:      dest.Name,
+			DestinationLabel: dest.Label,
+			Gateway:          rule.Gateway(),
+			GatewayLabel:     rule.Gateway(),
+			Families:         []string{rule.Family()},
+		}
+		if gw, err := getGatewayByName(rule.Gateway()); err == nil {
+			chosen.Gateway = gw.Name
+			chosen.GatewayLabel = gw.Label
+		}
+		if until, _, timed := parseExpiry(rule.Description()); timed {
+			chosen.Expires = &until
+			chosen.ExpiresIn = formatRemaining(time.Until(until))
+		}
+
+		indexes[dest.Name] = len(choices)
+		choices = append(choices, chosen)
+	}
+
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].Destination == catchAll.Name && choices[j].Destination != catchAll.Name
+	})
+
+	return choices, nil
+}
+
+// listAliasChoices lists the alias a source is in,
+// alias mode has no destination choices
+func listAliasChoices(ctx context.Context, iface, source string) ([]choice, error) {
+	rule, err := getActiveAliasRule(ctx, iface, source)
+	if err != nil || rule == nil {
+		return []choice{}, err
+	}
+
+	chosen := choice{
+		Destination:      catchAll.Name,
+		DestinationLabel: catchAll.Label,
+		Gateway:          rule.Gateway(),
+		GatewayLabel:     rule.Gateway(),
+		Families:         []string{rule.Family()},
+	}
+	if gw, err := getGatewayByName(rule.Gateway()); err == nil {
+		chosen.Gateway = gw.Name
+		chosen.GatewayLabel = gw.Label
+	}
+
+	return []choice{chosen}, nil
+}
+
+// removeChoice deletes the rules routing source's host to dest,
+// after which its traffic there follows its other choices
+func removeChoice(ctx context.Context, iface, source string, dest destination) error {
+	job, err := queueRemoval(ctx, iface, source, dest)
+	if err != nil {
+		return err
+	}
+
+	return job.Wait(ctx)
+}
+
+// queueRemoval queues what removeChoice does and returns right away
+func queueRemoval(ctx context.Context, iface, source string, dest destination) (*writeJob, error) {
+	if cfg.Mode == modeAlias && dest != catchAll {
+		return nil, fmt.Errorf("destination choices like %v need %v mode", dest.Name, modeRule)
+	}
+
+	return queueWrite(writeChange{
+		iface:   iface,
+		source:  source,
+		sources: dualStackSources(ctx, source),
+		dest:    dest,
+	}), nil
+}
+
+// applyRemovalLocked removes the choice of a queued change.
+// The caller must hold the state lock.
+func applyRemovalLocked(ctx context.Context, change writeChange) error {
+	iface, sources, dest := change.iface, change.sources, change.dest
+
+	if cfg.Mode == modeAlias {
+		return setAliasGatewayLocked(ctx, sources, deleteDork)
+	}
+
+	defer invalidateRules(iface)
+
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	// some remotes identify rules by their position, which deleting
+	// a rule shifts for every rule below it, so go from the bottom up
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if !strings.HasPrefix(rule.Description(), dork) || !containsSource(sources, rule.Source()) || !dest.matches(rule) || !change.touches(rule.Family()) {
+			continue
+		}
+
+		reportProgress(ctx, jobDeleting)
+		if err := rule.Delete(ctx); err != nil {
+			return err
+		}
+
+		deleted := rule
+		onRollback(ctx, func(ctx context.Context) error {
+			return restoreRule(ctx, iface, deleted)
+		})
+	}
+
+	return nil
+}
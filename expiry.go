@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// expiryPattern matches the end of a time-limited rule's description:
+// when it runs out and, in parentheses, the gateway to go back to
+var expiryPattern = regexp.MustCompile(` until (\S+)(?: then \(([^)]+)\))?$`)
+
+// expiryCheckInterval is the longest the scheduler sleeps, in case
+// a rule was changed behind our back
+const expiryCheckInterval = time.Minute
+
+// expiryWake tells the scheduler a new time limit was set
+var expiryWake = make(chan struct{}, 1)
+
+// expirySuffix records in a description that the rule runs out at
+// until, and then reverts to revert, or is removed if revert is empty
+func expirySuffix(until time.Time, revert string) string {
+	suffix := " until " + until.UTC().Format(time.RFC3339)
+	if revert != "" {
+		suffix += " then (" + revert + ")"
+	}
+
+	return suffix
+}
+
+// wakeExpiryScheduler makes the scheduler look for the soonest expiry again
+func wakeExpiryScheduler() {
+	select {
+	case expiryWake <- struct{}{}:
+	default:
+	}
+}
+
+// parseExpiry reads what expirySuffix recorded
+func parseExpiry(description string) (time.Time, string, bool) {
+	match := expiryPattern.FindStringSubmatch(description)
+	if match == nil {
+		return time.Time{}, "", false
+	}
+
+	until, err := time.Parse(time.RFC3339, match[1])
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	return until, match[2], true
+}
+
+// revertGateway is the gateway a time-limited choice replacing
+// previous goes back to: the one previous chose for good
+func revertGateway(previous remote.FirewallRule) string {
+	if previous == nil {
+		return ""
+	}
+
+	if _, revert, timed := parseExpiry(previous.Description()); timed {
+		return revert
+	}
+
+	return previous.Gateway()
+}
+
+// formatRemaining rounds d for display, like "1h25m"
+func formatRemaining(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+
+	remaining := d.Round(time.Minute).String()
+	return strings.TrimSuffix(remaining, "0s")
+}
+
+// revertExpired reverts or removes the time-limited rules on iface
+// that have run out, and returns when the next one does. The reverts
+// go through the write queue like the choices of users.
+func revertExpired(ctx context.Context, iface string) (time.Time, error) {
+	var rules []remote.FirewallRule
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		rules, err = readClient.ListRules(ctx, iface)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next := time.Time{}
+	reverts := []*writeJob{}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Description(), dork) {
+			continue
+		}
+
+		until, revert, timed := parseExpiry(rule.Description())
+		if !timed {
+			continue
+		}
+
+		if until.After(time.Now()) {
+			if next.IsZero() || until.Before(next) {
+				next = until
+			}
+			continue
+		}
+
+		change := writeChange{
+			iface:   iface,
+			source:  rule.Source(),
+			sources: []string{rule.Source()},
+			dest:    destinationOf(rule),
+			family:  rule.Family(),
+		}
+
+		if revert == "" {
+			log.Println("choice of", rule.Gateway(), "for", rule.Source(), "ran out, removing it")
+		} else if gw, err := getGatewayByName(revert); err != nil {
+			log.Println("choice of", rule.Gateway(), "for", rule.Source(), "ran out, removing it as", revert, "is no longer configured")
+		} else {
+			log.Println("choice of", rule.Gateway(), "for", rule.Source(), "ran out, going back to", revert)
+			change.gw = gw
+		}
+
+		reverts = append(reverts, queueWrite(change))
+	}
+
+	for _, job := range reverts {
+		if err := job.Wait(ctx); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return next, nil
+}
+
+// runExpiryScheduler reverts time-limited choices as they run out
+// until ctx is done. Expiries live in rule descriptions, so choices
+// that ran out while the picker was down are reverted on startup.
+func runExpiryScheduler(ctx context.Context) {
+	for {
+		wait := expiryCheckInterval
+
+		for _, iface := range interfaceNames() {
+			next, err := revertExpired(ctx, iface)
+			if err != nil {
+				log.Println("error reverting expired choices on", iface, err)
+				continue
+			}
+
+			if !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-expiryWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+func TestRevertExpiredGoesThroughWriteQueue(t *testing.T) {
+	testRemote := useTestRemote(t, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runWriteQueue(ctx)
+
+	family := remote.AddressFamily("10.0.0.2")
+	expired := dork + " user chose \"VPN\" (VPN)" + expirySuffix(time.Now().Add(-time.Minute), "WAN")
+	if _, err := testRemote.AddRule(ctx, "lan", family, "10.0.0.2", "*", "*", "*", "VPN", expired); err != nil {
+		t.Fatal(err)
+	}
+	running := dork + " user chose \"VPN\" (VPN)" + expirySuffix(time.Now().Add(time.Hour), "")
+	if _, err := testRemote.AddRule(ctx, "lan", family, "10.0.0.3", "*", "*", "*", "VPN", running); err != nil {
+		t.Fatal(err)
+	}
+
+	applied := testRemote.Applies()
+	next, err := revertExpired(ctx, "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(next) < 59*time.Minute {
+		t.Errorf("expected the next expiry in an hour, got %v", next)
+	}
+
+	rules, err := testRemote.ListRules(ctx, "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateways := map[string]string{}
+	for _, rule := range rules {
+		gateways[rule.Source()] = rule.Gateway()
+	}
+	if len(rules) != 2 || gateways["10.0.0.2"] != "WAN" || gateways["10.0.0.3"] != "VPN" {
+		t.Fatalf("expected 10.0.0.2 back on WAN and 10.0.0.3 left on VPN, got %v", gateways)
+	}
+	if testRemote.Applies()-applied != 1 {
+		t.Errorf("expected the revert to apply once, got %v applies", testRemote.Applies()-applied)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+type haRule struct {
+	Family      string `json:"family"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Protocol    string `json:"protocol"`
+	Port        string `json:"port"`
+	Gateway     string `json:"gateway"`
+	Description string `json:"description"`
+}
+
+type haDivergence struct {
+	Interface string   `json:"interface"`
+	Host      string   `json:"host"`
+	Missing   []haRule `json:"missing"`
+	Extra     []haRule `json:"extra"`
+}
+
+type haStatus struct {
+	Master     string         `json:"master"`
+	Divergence []haDivergence `json:"divergence"`
+}
+
+func toHARules(rules []remote.FirewallRule) []haRule {
+	converted := make([]haRule, len(rules))
+	for i, rule := range rules {
+		converted[i] = haRule{
+			Family:      rule.Family(),
+			Source:      rule.Source(),
+			Destination: rule.Destination(),
+			Protocol:    rule.Protocol(),
+			Port:        rule.Port(),
+			Gateway:     rule.Gateway(),
+			Description: rule.Description(),
+		}
+	}
+	return converted
+}
+
+// getHAStatus finds the master and compares the rules we manage
+// on every interface across the nodes
+func getHAStatus(ctx context.Context) (*haStatus, error) {
+	var status *haStatus
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		status, err = getHAStatusOf(ctx, readClient.(remote.HAClient))
+		return err
+	})
+
+	return status, err
+}
+
+func getHAStatusOf(ctx context.Context, haClient remote.HAClient) (*haStatus, error) {
+	master, err := haClient.Master(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &haStatus{
+		Master:     master,
+		Divergence: []haDivergence{},
+	}
+
+	for _, iface := range interfaceNames() {
+		divergences, err := haClient.Divergence(ctx, iface)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, divergence := range divergences {
+			status.Divergence = append(status.Divergence, haDivergence{
+				Interface: iface,
+				Host:      divergence.Host,
+				Missing:   toHARules(divergence.Missing),
+				Extra:     toHARules(divergence.Extra),
+			})
+		}
+	}
+
+	return status, nil
+}
+
+func logDivergence(ctx context.Context) {
+	status, err := getHAStatus(ctx)
+	if err != nil {
+		log.Println("error checking HA nodes", err)
+		return
+	}
+
+	log.Println("HA master is", status.Master)
+	for _, divergence := range status.Divergence {
+		log.Println("rules on", divergence.Host, "diverge from the master on", divergence.Interface+":", len(divergence.Missing), "missing,", len(divergence.Extra), "extra")
+	}
+}
+
+func handlerViewHAAPI(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		w.WriteHeader(403)
+		w.Write([]byte("only admins may view HA status"))
+		return
+	}
+
+	if _, ok := client.(remote.HAClient); !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("remote is not an HA group"))
+		return
+	}
+
+	status, err := getHAStatus(r.Context())
+	if err != nil {
+		log.Println("error checking HA nodes", err)
+		w.WriteHeader(500)
+		w.Write([]byte("could not check HA nodes"))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(status)
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -75,11 +78,38 @@ const rawTemplateViewGateways = `
 		}
 
 		.status--online { color: lawngreen; }
-		.status--offline { color: crimson; }
+		.status--degraded-latency, .status--degraded-loss { color: gold; }
+		.status--pending { color: #ababab; }
+		.status--down { color: crimson; }
+
+		.age { font-size: 0.8em; }
+
+		.choices form {
+			display: inline-flex;
+		}
 		</style>
 	</head>
+	{{ define "health" }}
+		{{ if (eq .HasKnownStatus true) }}
+		<div class="gateway__status">
+			<span class="status status--{{ .Status }}">{{ .StatusLabel }}</span>
+
+			<span>{{ .RoundtripTime }} &plusmn; {{ .RoundtripTimeDeviation }}</span>
+			<span>{{ printf "%.1f" .PacketLoss }}% loss</span>
+		</div>
+		{{ end }}
+	{{ end }}
+	{{ define "duration" }}
+	<select name="duration">
+		<option value="">for good</option>
+		<option value="1h">for 1 hour</option>
+		<option value="4h">for 4 hours</option>
+		<option value="24h">for a day</option>
+	</select>
+	{{ end }}
 	<body>
-		<p>Hello <strong>{{ .Source }}</strong></p>
+		<p>Hello <strong>{{ .Source }}</strong>{{ with .Interface }} on {{ . }}{{ end }}</p>
+		{{ with .Age }}<p class="age">as of {{ . }} ago</p>{{ end }}
 
 		<div class="gateways">
 			{{ range $element := .Gateways }}
@@ -87,57 +117,167 @@ const rawTemplateViewGateways = `
 					<div class="gateway gateway--active">
 						<strong>{{ $element.Label }}</strong>
 
-						{{ if (eq $element.HasKnownStatus true) }}
-						<div class="gateway__status">
-							{{ if (eq $element.Online true) }}
-							<span class="status status--online">Online</span>
-							{{ else }}
-							<span class="status status--offline">Offline</span>
-							{{ end }}
-
-							<span>{{ $element.RoundtripTime }}</span>
-						</div>
+						{{ template "health" $element }}
+						{{ with $element.IPv6 }}
+						<span>IPv6</span>
+						{{ template "health" . }}
 						{{ end }}
 
-						<span>(active)</span>
+						{{ if $element.ActiveVia }}
+						<span>(active via {{ $element.ActiveVia }}{{ with $element.ExpiresIn }}, {{ . }} left{{ end }})</span>
+						{{ else }}
+						<span>(active{{ with $element.ExpiresIn }}, {{ . }} left{{ end }})</span>
+						{{ end }}
 					</div>
 				{{ else }}
 					<div class="gateway gateway--inactive">
 						<span>{{ $element.Label }}</span>
 
-						{{ if (eq $element.HasKnownStatus true) }}
-						<div class="gateway__status">
-							{{ if (eq $element.Online true) }}
-							<span class="status status--online">Online</span>
-							{{ else }}
-							<span class="status status--offline">Offline</span>
-							{{ end }}
-							
-							<span>{{ $element.RoundtripTime }}</span>
-						</div>
+						{{ template "health" $element }}
+						{{ with $element.IPv6 }}
+						<span>IPv6</span>
+						{{ template "health" . }}
 						{{ end }}
 
-						<form method="POST">
+						<form method="POST" class="switch">
+							{{ template "duration" }}
 							<button type="submit" name="gateway" value="{{ $element.Name }}">Activate</button>
 						</form>
 					</div>
 				{{ end }}
 			{{ end }}
 		</div>
+
+		{{ if .Destinations }}
+		<div class="choices">
+			<p>Your choices:</p>
+			<ul>
+				{{ range $choice := .Choices }}
+				<li>
+					{{ $choice.DestinationLabel }} via {{ $choice.GatewayLabel }}{{ with $choice.ExpiresIn }} ({{ . }} left){{ end }}
+					<form method="POST">
+						<input type="hidden" name="destination" value="{{ $choice.Destination }}">
+						<button type="submit" name="action" value="delete">Remove</button>
+					</form>
+				</li>
+				{{ end }}
+			</ul>
+
+			<form method="POST" class="switch">
+				<select name="destination">
+					{{ range $destination := .Destinations }}
+					<option value="{{ $destination.Name }}">{{ $destination.Label }}</option>
+					{{ end }}
+				</select>
+				via
+				<select name="gateway">
+					{{ range $element := .Gateways }}
+					<option value="{{ $element.Name }}">{{ $element.Label }}</option>
+					{{ end }}
+				</select>
+				{{ template "duration" }}
+				<button type="submit">Choose</button>
+			</form>
+		</div>
+		{{ end }}
+
+		<p class="progress" id="progress"></p>
+
+		<script>
+			// switch through the async API to show progress while the
+			// firewall applies, the forms still work without scripts
+			const progress = document.getElementById("progress");
+			const buttons = document.querySelectorAll("button");
+
+			function finish(message) {
+				progress.textContent = message;
+				buttons.forEach(function (button) { button.disabled = false; });
+			}
+
+			function follow(job) {
+				if (job.state === "done") {
+					location.reload();
+					return;
+				}
+				if (job.state === "failed") {
+					finish("failed: " + job.error);
+					return;
+				}
+
+				progress.textContent = job.state + "...";
+				setTimeout(function () {
+					fetch("/api/jobs/" + job.id)
+						.then(function (response) { return response.json(); })
+						.then(follow)
+						.catch(function (error) { finish("failed: " + error.message); });
+				}, 500);
+			}
+
+			document.querySelectorAll("form.switch").forEach(function (form) {
+				form.addEventListener("submit", function (event) {
+					event.preventDefault();
+
+					const params = new URLSearchParams(new FormData(form));
+					if (event.submitter && event.submitter.name) {
+						params.set(event.submitter.name, event.submitter.value);
+					}
+					params.set("async", "true");
+
+					buttons.forEach(function (button) { button.disabled = true; });
+					progress.textContent = "queued...";
+
+					fetch("/api/gateways", { method: "POST", body: params })
+						.then(function (response) {
+							if (!response.ok) {
+								return response.text().then(function (text) { throw new Error(text); });
+							}
+							return response.json();
+						})
+						.then(follow)
+						.catch(function (error) { finish("failed: " + error.message); });
+				});
+			});
+		</script>
 	</body>
 </html>
 `
 
 var templateViewGateways = template.Must(template.New("viewGateways").Parse(rawTemplateViewGateways))
 
+// gatewayHealth is the monitored state of one gateway
+type gatewayHealth struct {
+	HasKnownStatus         bool    `json:"has_known_status"`
+	MonitorAddress         string  `json:"monitor_address"`
+	RoundtripTime          string  `json:"roundtrip_time"`
+	RoundtripTimeDeviation string  `json:"roundtrip_time_deviation"`
+	PacketLoss             float64 `json:"packet_loss"`
+	Status                 string  `json:"status"`
+	StatusLabel            string  `json:"status_label"`
+	Online                 bool    `json:"online"`
+}
+
 type gatewayWithState struct {
 	Name   string `json:"name"`
 	Label  string `json:"label"`
 	Active bool   `json:"active"`
+	// ActiveVia is the subnet or alias the choice was inherited from
+	ActiveVia string `json:"active_via,omitempty"`
+	// Expires is when a time-limited choice is reverted
+	Expires   *time.Time `json:"expires,omitempty"`
+	ExpiresIn string     `json:"expires_in,omitempty"`
+
+	gatewayHealth
 
-	HasKnownStatus bool   `json:"has_known_status"`
-	RoundtripTime  string `json:"roundtrip_time"`
-	Online         bool   `json:"online"`
+	// IPv6 is the health of the IPv6 counterpart, if there is one
+	IPv6 *gatewayHealth `json:"ipv6,omitempty"`
+}
+
+var gatewayStatusLabels = map[remote.GatewayStatus]string{
+	remote.GatewayOnline:          "Online",
+	remote.GatewayDegradedLatency: "High latency",
+	remote.GatewayDegradedLoss:    "Packet loss",
+	remote.GatewayPending:         "Pending",
+	remote.GatewayDown:            "Offline",
 }
 
 func getSource(r *http.Request) (string, error) {
@@ -159,13 +299,134 @@ func getSource(r *http.Request) (string, error) {
 	return ip, err
 }
 
-func getGatewaysWithState(source string) ([]gatewayWithState, error) {
-	gateways := cfg.Gateways
+func isAdmin(r *http.Request) bool {
+	source, err := getSource(r)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return false
+	}
+
+	for _, admin := range cfg.AdminNetworks {
+		if _, network, err := net.ParseCIDR(admin); err == nil && network.Contains(ip) {
+			return true
+		}
+		if adminIP := net.ParseIP(admin); adminIP != nil && adminIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var aliasSourcePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,31}$`)
+
+var errNotAdmin = errors.New("only admins may choose for other sources")
+
+// getRequestedSource returns the "source" form value if an admin sent
+// one, or else the source of the request itself.
+// Subnets are normalized to their network address like "10.0.0.0/24".
+func getRequestedSource(r *http.Request) (string, error) {
+	requested := r.FormValue("source")
+	if requested == "" {
+		return getSource(r)
+	}
+
+	if !isAdmin(r) {
+		return "", errNotAdmin
+	}
+
+	if ip := net.ParseIP(requested); ip != nil {
+		return ip.String(), nil
+	}
+
+	if _, network, err := net.ParseCIDR(requested); err == nil {
+		return network.String(), nil
+	}
+
+	if aliasSourcePattern.MatchString(requested) {
+		return requested, nil
+	}
+
+	return "", fmt.Errorf("source %q is not an address, subnet or alias", requested)
+}
+
+// getRequestedInterface returns the "interface" form value if an admin
+// sent one, or else the interface source is on
+func getRequestedInterface(r *http.Request, source string) (*networkInterface, error) {
+	requested := r.FormValue("interface")
+	if requested == "" {
+		return interfaceFor(r.Context(), source)
+	}
+
+	if !isAdmin(r) {
+		return nil, errNotAdmin
+	}
+
+	return getInterfaceByName(requested)
+}
+
+// getRequestedUntil returns when the choice requested with the
+// "duration" form value, like "2h", should be reverted.
+// Without a duration the choice is kept for good and until is zero.
+func getRequestedUntil(r *http.Request) (time.Time, error) {
+	requested := r.FormValue("duration")
+	if requested == "" {
+		return time.Time{}, nil
+	}
+
+	duration, err := time.ParseDuration(requested)
+	if err != nil || duration <= 0 {
+		return time.Time{}, errors.New("duration must be positive, like 30m or 2h")
+	}
+
+	return time.Now().Add(duration), nil
+}
+
+func writeSourceError(w http.ResponseWriter, err error) {
+	if err == errNotAdmin {
+		w.WriteHeader(403)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(400)
+	w.Write([]byte(err.Error()))
+}
+
+func getGatewayHealth(gatewayStatusMap map[string]remote.Gateway, statusName string) gatewayHealth {
+	health := gatewayHealth{}
+
+	status, found := gatewayStatusMap[statusName]
+	if !found {
+		return health
+	}
+
+	health.HasKnownStatus = true
+	health.MonitorAddress = status.MonitorAddress()
+	health.RoundtripTime = status.RoundtripTime().String()
+	health.RoundtripTimeDeviation = status.RoundtripTimeDeviation().String()
+	health.PacketLoss = status.PacketLoss()
+	health.Status = string(status.Status())
+	health.StatusLabel = gatewayStatusLabels[status.Status()]
+	// degraded gateways still pass traffic
+	health.Online = status.Status() != remote.GatewayDown && status.Status() != remote.GatewayPending
+
+	return health
+}
+
+// getGatewaysWithState also returns when the oldest of the state
+// it is made of was read from the remote
+func getGatewaysWithState(ctx context.Context, ni networkInterface, source string) ([]gatewayWithState, time.Time, error) {
+	gateways := ni.Gateways
 	activeGatewayName := deleteDork
 
-	gatewayStatus, err := getGatewayStatus()
+	gatewayStatus, updated, err := cachedGatewayStatus(ctx)
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
 	gatewayStatusMap := make(map[string]remote.Gateway, len(gatewayStatus))
@@ -173,34 +434,70 @@ func getGatewaysWithState(source string) ([]gatewayWithState, error) {
 		gatewayStatusMap[gateway.Name()] = gateway
 	}
 
-	activeRule, err := getActiveRule(cfg.RemoteInterface, source)
+	activeRule, rulesUpdated, err := getActiveRule(ctx, ni.Name, source)
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
+	}
+	if rulesUpdated.Before(updated) {
+		updated = rulesUpdated
 	}
 
+	activeVia := ""
+	var expires *time.Time
 	if activeRule != nil {
 		activeGatewayName = activeRule.Gateway()
+		if activeRule.Source() != source {
+			activeVia = activeRule.Source()
+		}
+		if until, _, timed := parseExpiry(activeRule.Description()); timed {
+			expires = &until
+		}
 	}
 
 	gatewaysWithState := make([]gatewayWithState, len(gateways))
 	for i, gateway := range gateways {
 		gatewaysWithState[i].Name = gateway.Name
 		gatewaysWithState[i].Label = gateway.Label
-		gatewaysWithState[i].Active = gateway.Name == activeGatewayName
+		// IPv6 sources are routed by the IPv6 counterpart
+		gatewaysWithState[i].Active = gateway.Name == activeGatewayName || (gateway.Name6 != "" && gateway.Name6 == activeGatewayName)
+		if gatewaysWithState[i].Active {
+			gatewaysWithState[i].ActiveVia = activeVia
+			if expires != nil {
+				gatewaysWithState[i].Expires = expires
+				gatewaysWithState[i].ExpiresIn = formatRemaining(time.Until(*expires))
+			}
+		}
+		gatewaysWithState[i].gatewayHealth = getGatewayHealth(gatewayStatusMap, gateway.StatusName)
 
-		if status, found := gatewayStatusMap[gateway.StatusName]; found {
-			gatewaysWithState[i].HasKnownStatus = true
-			gatewaysWithState[i].RoundtripTime = status.RoundtripTime()
-			gatewaysWithState[i].Online = status.Online()
+		if gateway.Name6 != "" && gateway.Name6 != gateway.Name {
+			health := getGatewayHealth(gatewayStatusMap, gateway.StatusName6)
+			gatewaysWithState[i].IPv6 = &health
 		}
 	}
 
-	return gatewaysWithState, nil
+	return gatewaysWithState, updated, nil
+}
+
+// formatAge describes how long ago updated was for the page,
+// or returns an empty string if it was just now
+func formatAge(updated time.Time) string {
+	age := time.Since(updated).Round(time.Second)
+	if age < time.Second {
+		return ""
+	}
+
+	return age.String()
 }
 
+// writeAge sets the Age header to how long ago updated was
+func writeAge(w http.ResponseWriter, updated time.Time) {
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(updated).Seconds())))
+}
+
+// getGatewayByName finds a gateway by its IPv4 or IPv6 name
 func getGatewayByName(gatewayName string) (*gateway, error) {
 	for _, gateway := range cfg.Gateways {
-		if gateway.Name == gatewayName {
+		if gateway.Name == gatewayName || (gateway.Name6 != "" && gateway.Name6 == gatewayName) {
 			return &gateway, nil
 		}
 	}
@@ -208,6 +505,25 @@ func getGatewayByName(gatewayName string) (*gateway, error) {
 	return nil, errors.New("gateway not found")
 }
 
+func writeSetGatewayError(w http.ResponseWriter, source string, err error) {
+	log.Println("error setting gateway for", source, err)
+
+	w.WriteHeader(500)
+
+	var switchErr *switchError
+	if !errors.As(err, &switchErr) {
+		w.Write([]byte("failed to set gateway"))
+		return
+	}
+
+	if switchErr.rollbackErr != nil {
+		w.Write([]byte("failed to set gateway, and failed to restore your previous gateway"))
+		return
+	}
+
+	w.Write([]byte("failed to set gateway, your previous gateway was restored"))
+}
+
 func handlerViewGateways(w http.ResponseWriter, r *http.Request) {
 	ip, err := getSource(r)
 	if err != nil {
@@ -216,21 +532,49 @@ func handlerViewGateways(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gatewaysWithState, err := getGatewaysWithState(ip)
+	ni, err := interfaceFor(r.Context(), ip)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	gatewaysWithState, updated, err := getGatewaysWithState(r.Context(), *ni, ip)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte("could not get gateways with state"))
 		return
 	}
 
+	choices := []choice{}
+	if len(cfg.Destinations) > 0 {
+		choices, err = listChoices(r.Context(), ni.Name, ip)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte("could not list choices"))
+			return
+		}
+	}
+
 	w.Header().Add("Content-Type", "text/html")
+	writeAge(w, updated)
 
 	err = templateViewGateways.Execute(w, struct {
-		Gateways []gatewayWithState
-		Source   string
+		Gateways     []gatewayWithState
+		Choices      []choice
+		Destinations []destination
+		Source       string
+		// Interface is only shown if there is more than one
+		Interface string
+		// Age is how old the status shown is, if it is not live
+		Age string
 	}{
-		Gateways: gatewaysWithState,
-		Source:   ip,
+		Gateways:     gatewaysWithState,
+		Choices:      choices,
+		Destinations: cfg.Destinations,
+		Source:       ip,
+		Interface:    interfaceLabel(*ni),
+		Age:          formatAge(updated),
 	})
 	if err != nil {
 		log.Println("error rendering ViewGateways:", err)
@@ -245,17 +589,50 @@ func handlerSetGateway(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gateway, err := getGatewayByName(r.FormValue("gateway"))
+	ni, err := interfaceFor(r.Context(), ip)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	dest, err := getDestinationByName(r.FormValue("destination"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("destination not found"))
+		return
+	}
+
+	if r.FormValue("action") == "delete" {
+		err = removeChoice(r.Context(), ni.Name, ip, *dest)
+		if err != nil {
+			log.Println("error removing choice for", ip, err)
+			w.WriteHeader(500)
+			w.Write([]byte("failed to remove choice"))
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	gateway, err := ni.gatewayByName(r.FormValue("gateway"))
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte("gateway not found"))
 		return
 	}
 
-	_, err = setGateway(cfg.RemoteInterface, ip, gateway.Name, gateway.Label)
+	until, err := getRequestedUntil(r)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte("failed to set gateway"))
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = chooseGateway(r.Context(), ni.Name, ip, *dest, *gateway, until)
+	if err != nil {
+		writeSetGatewayError(w, ip, err)
 		return
 	}
 
@@ -263,14 +640,19 @@ func handlerSetGateway(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlerViewGatewaysAPI(w http.ResponseWriter, r *http.Request) {
-	ip, err := getSource(r)
+	ip, err := getRequestedSource(r)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte("could not get source"))
+		writeSourceError(w, err)
+		return
+	}
+
+	ni, err := getRequestedInterface(r, ip)
+	if err != nil {
+		writeSourceError(w, err)
 		return
 	}
 
-	gatewaysWithState, err := getGatewaysWithState(ip)
+	gatewaysWithState, updated, err := getGatewaysWithState(r.Context(), *ni, ip)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte("could not get gateways with state"))
@@ -278,29 +660,120 @@ func handlerViewGatewaysAPI(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Add("Content-Type", "application/json")
+	writeAge(w, updated)
 
 	json.NewEncoder(w).Encode(gatewaysWithState)
 }
 
 func handlerSetGatewayAPI(w http.ResponseWriter, r *http.Request) {
-	ip, err := getSource(r)
+	ip, err := getRequestedSource(r)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte("could not get source"))
+		writeSourceError(w, err)
 		return
 	}
 
-	gateway, err := getGatewayByName(r.FormValue("gateway"))
+	ni, err := getRequestedInterface(r, ip)
+	if err != nil {
+		writeSourceError(w, err)
+		return
+	}
+
+	dest, err := getDestinationByName(r.FormValue("destination"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("destination not found"))
+		return
+	}
+
+	gateway, err := ni.gatewayByName(r.FormValue("gateway"))
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte("gateway not found"))
 		return
 	}
 
-	_, err = setGateway(cfg.RemoteInterface, ip, gateway.Name, gateway.Label)
+	until, err := getRequestedUntil(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	job, err := queueChoice(r.Context(), ni.Name, ip, *dest, *gateway, until)
+	if err != nil {
+		writeSetGatewayError(w, ip, err)
+		return
+	}
+
+	// async callers follow the job at /api/jobs/{id} themselves
+	if async, _ := strconv.ParseBool(r.FormValue("async")); async {
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Location", "/api/jobs/"+job.ID)
+		w.WriteHeader(202)
+
+		json.NewEncoder(w).Encode(job.status())
+		return
+	}
+
+	err = job.Wait(r.Context())
+	if err != nil {
+		writeSetGatewayError(w, ip, err)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func handlerViewChoicesAPI(w http.ResponseWriter, r *http.Request) {
+	ip, err := getRequestedSource(r)
+	if err != nil {
+		writeSourceError(w, err)
+		return
+	}
+
+	ni, err := getRequestedInterface(r, ip)
+	if err != nil {
+		writeSourceError(w, err)
+		return
+	}
+
+	choices, err := listChoices(r.Context(), ni.Name, ip)
 	if err != nil {
 		w.WriteHeader(500)
-		w.Write([]byte("failed to set gateway"))
+		w.Write([]byte("could not list choices"))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(choices)
+}
+
+func handlerDeleteChoiceAPI(w http.ResponseWriter, r *http.Request) {
+	ip, err := getRequestedSource(r)
+	if err != nil {
+		writeSourceError(w, err)
+		return
+	}
+
+	ni, err := getRequestedInterface(r, ip)
+	if err != nil {
+		writeSourceError(w, err)
+		return
+	}
+
+	dest, err := getDestinationByName(r.FormValue("destination"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("destination not found"))
+		return
+	}
+
+	err = removeChoice(r.Context(), ni.Name, ip, *dest)
+	if err != nil {
+		log.Println("error removing choice for", ip, err)
+		w.WriteHeader(500)
+		w.Write([]byte("failed to remove choice"))
 		return
 	}
 
@@ -313,6 +786,11 @@ func bootServer(ctx context.Context) chan error {
 		routeDef{"POST", "/", "SetGateway", handlerSetGateway},
 		routeDef{"GET", "/api/gateways", "ViewGatewaysAPI", handlerViewGatewaysAPI},
 		routeDef{"POST", "/api/gateways", "SetGatewayAPI", handlerSetGatewayAPI},
+		routeDef{"GET", "/api/choices", "ViewChoicesAPI", handlerViewChoicesAPI},
+		routeDef{"DELETE", "/api/choices", "DeleteChoiceAPI", handlerDeleteChoiceAPI},
+		routeDef{"GET", "/api/ha", "ViewHAAPI", handlerViewHAAPI},
+		routeDef{"POST", "/api/reconcile", "ReconcileAPI", handlerReconcileAPI},
+		routeDef{"GET", "/api/jobs/{id}", "ViewJobAPI", handlerViewJobAPI},
 	})
 
 	src := &http.Server{
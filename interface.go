@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// interfaceLock guards the subnets of cfg.Interfaces,
+// which may be loaded from the remote after startup
+var interfaceLock sync.Mutex
+var interfacesLoaded bool
+
+// loadInterfaceSubnets asks the remote for the subnets of interfaces
+// configured without any. A single interface needs none: it serves
+// every request. The remote is asked without holding interfaceLock,
+// so lookups of loaded interfaces never wait for it.
+func loadInterfaceSubnets(ctx context.Context) error {
+	interfaceLock.Lock()
+	missing := missingInterfaceSubnetsLocked()
+	interfaceLock.Unlock()
+
+	if !missing {
+		return nil
+	}
+
+	if _, ok := client.(remote.InterfaceClient); !ok {
+		return errors.New("remote cannot list interfaces, configure their subnets instead")
+	}
+
+	var remoteInterfaces []remote.Interface
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		remoteInterfaces, err = readClient.(remote.InterfaceClient).ListInterfaces(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	subnets := map[string][]*net.IPNet{}
+	for _, remoteInterface := range remoteInterfaces {
+		for _, subnet := range remoteInterface.Subnets {
+			if _, network, err := net.ParseCIDR(subnet); err == nil {
+				subnets[remoteInterface.Name] = append(subnets[remoteInterface.Name], network)
+			}
+		}
+	}
+
+	interfaceLock.Lock()
+	defer interfaceLock.Unlock()
+
+	// another request may have loaded them in the meantime
+	if interfacesLoaded {
+		return nil
+	}
+
+	for _, ni := range cfg.Interfaces {
+		if len(ni.Subnets) == 0 && len(subnets[ni.Name]) == 0 {
+			return fmt.Errorf("remote has no subnets for interface %v", ni.Name)
+		}
+	}
+
+	for i, ni := range cfg.Interfaces {
+		if len(ni.Subnets) == 0 {
+			cfg.Interfaces[i].Subnets = subnets[ni.Name]
+		}
+	}
+
+	interfacesLoaded = true
+	return nil
+}
+
+// missingInterfaceSubnetsLocked reports whether some interface still
+// needs its subnets loaded. The caller must hold interfaceLock.
+func missingInterfaceSubnetsLocked() bool {
+	if interfacesLoaded || len(cfg.Interfaces) <= 1 {
+		return false
+	}
+
+	for _, ni := range cfg.Interfaces {
+		if len(ni.Subnets) == 0 {
+			return true
+		}
+	}
+
+	interfacesLoaded = true
+	return false
+}
+
+// interfaceFor picks the interface whose subnet holds source,
+// the narrowest if several do. Subnet sources must lie within it.
+func interfaceFor(ctx context.Context, source string) (*networkInterface, error) {
+	if err := loadInterfaceSubnets(ctx); err != nil {
+		return nil, err
+	}
+
+	interfaceLock.Lock()
+	defer interfaceLock.Unlock()
+
+	if len(cfg.Interfaces) == 1 {
+		ni := cfg.Interfaces[0]
+		return &ni, nil
+	}
+
+	ip := net.ParseIP(source)
+	sourceOnes := -1
+	if ip == nil {
+		var sourceNetwork *net.IPNet
+		var err error
+		ip, sourceNetwork, err = net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("cannot detect the interface of %v, choose one", source)
+		}
+		sourceOnes, _ = sourceNetwork.Mask.Size()
+	}
+
+	var found *networkInterface
+	foundOnes := -1
+	for _, ni := range cfg.Interfaces {
+		for _, subnet := range ni.Subnets {
+			ones, _ := subnet.Mask.Size()
+			if !subnet.Contains(ip) || (sourceOnes >= 0 && ones > sourceOnes) || ones <= foundOnes {
+				continue
+			}
+
+			ni := ni
+			found = &ni
+			foundOnes = ones
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%v is not on any of our interfaces", source)
+	}
+
+	return found, nil
+}
+
+// interfaceNames lists the configured interfaces. Loops over them
+// must not range over cfg.Interfaces, whose subnets may be loaded
+// while they run.
+func interfaceNames() []string {
+	interfaceLock.Lock()
+	defer interfaceLock.Unlock()
+
+	names := make([]string, len(cfg.Interfaces))
+	for i, ni := range cfg.Interfaces {
+		names[i] = ni.Name
+	}
+
+	return names
+}
+
+// getInterfaceByName finds a configured interface
+func getInterfaceByName(interfaceName string) (*networkInterface, error) {
+	interfaceLock.Lock()
+	defer interfaceLock.Unlock()
+
+	for _, ni := range cfg.Interfaces {
+		if ni.Name == interfaceName {
+			return &ni, nil
+		}
+	}
+
+	return nil, errors.New("interface not found")
+}
+
+func interfaceLabel(ni networkInterface) string {
+	if len(cfg.Interfaces) <= 1 {
+		return ""
+	}
+
+	return ni.Name
+}
+
+// gatewayByName finds a gateway users on ni may choose
+func (ni networkInterface) gatewayByName(gatewayName string) (*gateway, error) {
+	for _, gateway := range ni.Gateways {
+		if gateway.Name == gatewayName || (gateway.Name6 != "" && gateway.Name6 == gatewayName) {
+			return &gateway, nil
+		}
+	}
+
+	return nil, errors.New("gateway not found")
+}
+
+// offers reports whether users on ni may choose gw
+func (ni networkInterface) offers(gw gateway) bool {
+	_, err := ni.gatewayByName(gw.Name)
+	return err == nil
+}
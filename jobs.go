@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// jobRetention is how long finished jobs can still be looked up
+const jobRetention = 10 * time.Minute
+
+// jobs are the write jobs by ID, for the API to report on
+var jobs = struct {
+	lock sync.Mutex
+	byID map[string]*writeJob
+}{
+	byID: map[string]*writeJob{},
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// registerJob makes job available to getJob, and forgets
+// jobs that finished more than jobRetention ago
+func registerJob(job *writeJob) {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+
+	for id, existing := range jobs.byID {
+		existing.lock.Lock()
+		expired := !existing.finishedAt.IsZero() && time.Since(existing.finishedAt) > jobRetention
+		existing.lock.Unlock()
+
+		if expired {
+			delete(jobs.byID, id)
+		}
+	}
+
+	jobs.byID[job.ID] = job
+}
+
+func getJob(id string) *writeJob {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+
+	return jobs.byID[id]
+}
+
+// jobStatus is how the API reports a job
+type jobStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// Error explains why the job failed
+	Error string `json:"error,omitempty"`
+	// Abandoned tells that everyone waiting on the job gave up before
+	// it finished. Unless it failed, its change was made anyway.
+	Abandoned bool `json:"abandoned,omitempty"`
+}
+
+func (job *writeJob) status() jobStatus {
+	state, err := job.Status()
+
+	job.lock.Lock()
+	abandoned := job.abandoned
+	job.lock.Unlock()
+
+	status := jobStatus{
+		ID:        job.ID,
+		State:     state,
+		Abandoned: abandoned,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+func handlerViewJobAPI(w http.ResponseWriter, r *http.Request) {
+	job := getJob(mux.Vars(r)["id"])
+	if job == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("job not found"))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(job.status())
+}
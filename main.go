@@ -2,19 +2,75 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 
 	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
 	"github.com/caarlos0/env"
-	"github.com/imroc/req"
 )
 
 var client remote.Client
 var cfg config
 
+func anyIfEmpty(value string) string {
+	if value == "" {
+		return "*"
+	}
+
+	return value
+}
+
+// newClient connects to one remote host
+func newClient(host string, sessionOptions remote.SessionOptions, profiles []remote.SensemillaProfile) (remote.Client, error) {
+	switch cfg.RemoteType {
+	case "sensemilla":
+		return remote.NewSensemillaClient(host, cfg.RemoteUsername, cfg.RemotePassword, sessionOptions, profiles)
+	case "opnsense":
+		return remote.NewOPNsenseClient(host, cfg.RemoteUsername, cfg.RemotePassword, sessionOptions)
+	case "rest":
+		return remote.NewRESTClient(host, cfg.RemoteUsername, cfg.RemotePassword, sessionOptions)
+	case "linux":
+		tables := make(map[string]string, len(cfg.Gateways))
+		for _, gateway := range cfg.Gateways {
+			tables[gateway.Name] = gateway.Table
+		}
+
+		return remote.NewLinuxClient(remote.LocalExecutor{}, remote.LinuxConfig{
+			Mode:                cfg.LinuxMode,
+			Tables:              tables,
+			RulePriority:        cfg.LinuxRulePriority,
+			StateFile:           cfg.LinuxStateFile,
+			RestoredDescription: dork + " restored",
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unknown remote type %v", cfg.RemoteType)
+}
+
+// newRemote creates a client for cfg.RemoteHosts, an HA client if
+// there are several
+func newRemote(sessionOptions remote.SessionOptions, profiles []remote.SensemillaProfile) (remote.Client, error) {
+	nodes := make([]remote.Client, len(cfg.RemoteHosts))
+	for i, host := range cfg.RemoteHosts {
+		node, err := newClient(host, sessionOptions, profiles)
+		if err != nil {
+			return nil, fmt.Errorf("error creating remote client for %v: %v", host, err)
+		}
+		nodes[i] = node
+	}
+
+	if len(nodes) > 1 {
+		return remote.NewHAClient(cfg.RemoteHosts, nodes, cfg.HAMode)
+	}
+
+	return nodes[0], nil
+}
+
 func main() {
 	if err := env.Parse(&cfg); err != nil {
 		log.Fatalln("error parsing config", err)
@@ -30,20 +86,191 @@ func main() {
 		cfg.GatewayStatusNames = cfg.GatewayNames
 	}
 
+	if len(cfg.GatewayTables) != len(cfg.GatewayNames) {
+		if cfg.RemoteType == "linux" {
+			log.Println("gateway table and name mismatch, using names as tables")
+		}
+		cfg.GatewayTables = cfg.GatewayNames
+	}
+
+	if len(cfg.GatewayNames6) != len(cfg.GatewayNames) {
+		if len(cfg.GatewayNames6) > 0 {
+			log.Println("IPv6 gateway and name mismatch, ignoring IPv6 gateways")
+		}
+		cfg.GatewayNames6 = make([]string, len(cfg.GatewayNames))
+	}
+
+	if len(cfg.GatewayStatusNames6) != len(cfg.GatewayNames6) {
+		cfg.GatewayStatusNames6 = cfg.GatewayNames6
+	}
+
+	if len(cfg.GatewayKillStates) != len(cfg.GatewayNames) {
+		if len(cfg.GatewayKillStates) > 0 {
+			log.Println("gateway kill states and name mismatch, keeping states on every gateway")
+		}
+		cfg.GatewayKillStates = make([]bool, len(cfg.GatewayNames))
+	}
+
+	if len(cfg.GatewayInterfaces) != len(cfg.GatewayNames) {
+		if len(cfg.GatewayInterfaces) > 0 {
+			log.Println("gateway interface and name mismatch, killing every state of switched sources")
+		}
+		cfg.GatewayInterfaces = make([]string, len(cfg.GatewayNames))
+	}
+
 	gateways := make([]gateway, len(cfg.GatewayNames))
 	for i, gatewayName := range cfg.GatewayNames {
 		gateways[i].Name = gatewayName
 		gateways[i].Label = cfg.GatewayLabels[i]
 		gateways[i].StatusName = cfg.GatewayStatusNames[i]
+		gateways[i].Table = cfg.GatewayTables[i]
+		gateways[i].Name6 = cfg.GatewayNames6[i]
+		gateways[i].StatusName6 = cfg.GatewayStatusNames6[i]
+		gateways[i].KillStates = cfg.GatewayKillStates[i]
+		gateways[i].Interface = cfg.GatewayInterfaces[i]
 	}
 	cfg.Gateways = gateways
 
-	if cfg.Debug {
-		req.SetFlags(req.LreqHead | req.LreqBody)
-		req.Debug = true
+	if len(cfg.DestinationLabels) != len(cfg.DestinationNames) {
+		log.Println("destination label and name mismatch, using names as labels")
+		cfg.DestinationLabels = cfg.DestinationNames
+	}
+
+	if len(cfg.DestinationAddresses) != len(cfg.DestinationNames) {
+		log.Fatalln("destination address and name mismatch")
+	}
+
+	if len(cfg.DestinationProtocols) != len(cfg.DestinationNames) {
+		if len(cfg.DestinationProtocols) > 0 {
+			log.Println("destination protocol and name mismatch, matching any protocol")
+		}
+		cfg.DestinationProtocols = make([]string, len(cfg.DestinationNames))
+	}
+
+	if len(cfg.DestinationPorts) != len(cfg.DestinationNames) {
+		if len(cfg.DestinationPorts) > 0 {
+			log.Println("destination port and name mismatch, matching any port")
+		}
+		cfg.DestinationPorts = make([]string, len(cfg.DestinationNames))
+	}
+
+	destinations := make([]destination, len(cfg.DestinationNames))
+	for i, destinationName := range cfg.DestinationNames {
+		if destinationName == catchAll.Name {
+			log.Fatalln("destination name", destinationName, "is reserved")
+		}
+
+		destinations[i].Name = destinationName
+		destinations[i].Label = cfg.DestinationLabels[i]
+		destinations[i].Address = cfg.DestinationAddresses[i]
+		destinations[i].Protocol = anyIfEmpty(strings.ToLower(cfg.DestinationProtocols[i]))
+		destinations[i].Port = anyIfEmpty(cfg.DestinationPorts[i])
+
+		if destinations[i].Port != "*" && destinations[i].Protocol == "*" {
+			log.Fatalln("destination", destinationName, "has a port but no protocol")
+		}
+	}
+	cfg.Destinations = destinations
+
+	if len(cfg.RemoteInterfaces) == 0 {
+		cfg.RemoteInterfaces = []string{cfg.RemoteInterface}
+	}
+
+	if len(cfg.InterfaceSubnets) != len(cfg.RemoteInterfaces) {
+		if len(cfg.InterfaceSubnets) > 0 {
+			log.Println("interface subnet and name mismatch, loading subnets from the remote")
+		}
+		cfg.InterfaceSubnets = make([]string, len(cfg.RemoteInterfaces))
+	}
+
+	if len(cfg.InterfaceGateways) != len(cfg.RemoteInterfaces) {
+		if len(cfg.InterfaceGateways) > 0 {
+			log.Println("interface gateway and name mismatch, offering every gateway on every interface")
+		}
+		cfg.InterfaceGateways = make([]string, len(cfg.RemoteInterfaces))
+	}
+
+	interfaces := make([]networkInterface, len(cfg.RemoteInterfaces))
+	for i, interfaceName := range cfg.RemoteInterfaces {
+		interfaces[i].Name = interfaceName
+
+		for _, subnet := range strings.Fields(cfg.InterfaceSubnets[i]) {
+			_, network, err := net.ParseCIDR(subnet)
+			if err != nil {
+				log.Fatalln("error parsing subnet of interface", interfaceName, err)
+			}
+			interfaces[i].Subnets = append(interfaces[i].Subnets, network)
+		}
+
+		interfaces[i].Gateways = cfg.Gateways
+		if gatewayNames := strings.Fields(cfg.InterfaceGateways[i]); len(gatewayNames) > 0 {
+			interfaces[i].Gateways = make([]gateway, len(gatewayNames))
+			for j, gatewayName := range gatewayNames {
+				gw, err := getGatewayByName(gatewayName)
+				if err != nil {
+					log.Fatalln("interface", interfaceName, "offers unknown gateway", gatewayName)
+				}
+				interfaces[i].Gateways[j] = *gw
+			}
+		}
+	}
+	cfg.Interfaces = interfaces
+
+	if cfg.Mode != modeRule && cfg.Mode != modeAlias {
+		log.Fatalln("unknown mode", cfg.Mode)
+	}
+
+	sessionOptions := remote.SessionOptions{
+		Timeout:           cfg.RemoteRequestTimeout,
+		IdleTimeout:       cfg.RemoteIdleTimeout,
+		DisableKeepAlives: cfg.RemoteDisableKeepAlives,
+		Proxy:             cfg.RemoteProxy,
+		InsecureTLS:       cfg.RemoteInsecureSkipVerify,
+		Debug:             cfg.Debug,
+	}
+
+	var profiles []remote.SensemillaProfile
+	if cfg.RemoteType == "sensemilla" && cfg.SensemillaProfiles != "" {
+		var err error
+		profiles, err = remote.LoadSensemillaProfiles(cfg.SensemillaProfiles)
+		if err != nil {
+			log.Fatalln("error loading sensemilla profiles", err)
+		}
 	}
 
-	client = remote.NewSensemillaClient(cfg.RemoteHost, cfg.RemoteUsername, cfg.RemotePassword)
+	if len(cfg.RemoteHosts) == 0 {
+		cfg.RemoteHosts = []string{cfg.RemoteHost}
+	}
+
+	if len(cfg.RemoteHosts) > 1 && cfg.RemoteType == "linux" {
+		log.Fatalln("remote type linux manages the local host only")
+	}
+
+	var err error
+	client, err = newRemote(sessionOptions, profiles)
+	if err != nil {
+		log.Fatalln("error creating remote client", err)
+	}
+
+	// the local host has no sessions to pool
+	if cfg.ReadSessions > 0 && cfg.RemoteType != "linux" {
+		readPool = remote.NewClientPool(cfg.ReadSessions, cfg.ReadSessionIdleTimeout, func() (remote.Client, error) {
+			return newRemote(sessionOptions, profiles)
+		})
+	}
+
+	placement := remote.Placement{
+		Strategy: cfg.RulePlacement,
+		Marker:   cfg.RulePlacementMarker,
+		Prefix:   dork,
+	}
+	if placementClient, ok := client.(remote.PlacementClient); ok {
+		if err := placementClient.SetPlacement(placement); err != nil {
+			log.Fatalln("error setting rule placement", err)
+		}
+	} else if placement.Strategy != remote.DefaultPlacement.Strategy || placement.Marker != "" {
+		log.Println("remote type", cfg.RemoteType, "decides rule placement itself, ignoring", cfg.RulePlacement)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -52,13 +279,48 @@ func main() {
 
 	go func() {
 		log.Println("performing client self-check")
-		_, err := getGatewayStatus()
+		_, err := getGatewayStatus(ctx)
 		if err != nil {
 			log.Fatal("error during list gateways self-check", err)
 		}
 		log.Println("client self-check passed!")
+
+		err = loadInterfaceSubnets(ctx)
+		if err != nil {
+			log.Fatalln("error loading interface subnets", err)
+		}
+
+		if _, ok := client.(remote.HAClient); ok {
+			logDivergence(ctx)
+		}
+
+		if cfg.Mode == modeAlias {
+			log.Println("setting up aliases")
+			for _, iface := range interfaceNames() {
+				ni, err := getInterfaceByName(iface)
+				if err == nil {
+					err = setupAliases(ctx, *ni)
+				}
+				if err != nil {
+					log.Fatalln("error setting up aliases on", iface, err)
+				}
+			}
+			log.Println("aliases ready!")
+		} else {
+			go runExpiryScheduler(ctx)
+		}
+
+		if snapshotEnabled() {
+			go runPoller(ctx, cfg.PollInterval)
+		}
+
+		if cfg.ReconcileInterval > 0 {
+			go runReconciler(ctx, cfg.ReconcileInterval)
+		}
 	}()
 
+	go runWriteQueue(ctx)
+
 	serverFinished := bootServer(ctx)
 	gracefulWaitGroup.Add(1)
 	go func() {
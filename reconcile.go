@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// reconcileAction is a managed rule the reconciler removed, and why
+type reconcileAction struct {
+	Interface string `json:"interface"`
+	Reason    string `json:"reason"`
+	haRule
+}
+
+// ruleSlot identifies what a managed rule decides: the gateway for
+// one family of one source to one destination. Only the first rule
+// for a slot is ever matched, any later one is a duplicate.
+func ruleSlot(rule remote.FirewallRule) string {
+	return strings.Join([]string{rule.Family(), rule.Source(), rule.Destination(), rule.Protocol(), rule.Port()}, "|")
+}
+
+// reconcile removes the managed rules on every interface that are
+// shadowed by an earlier rule for the same slot, left over from
+// crashes or concurrent edits, or that route through gateways no
+// longer configured
+func reconcile(ctx context.Context) ([]reconcileAction, error) {
+	actions := []reconcileAction{}
+	for _, iface := range interfaceNames() {
+		removed, err := reconcileInterface(ctx, iface)
+		actions = append(actions, removed...)
+		if err != nil {
+			return actions, err
+		}
+	}
+
+	return actions, nil
+}
+
+// reconcileInterface reconciles the rules on iface. It looks without
+// the state lock first, and only takes it if there is something to
+// remove, for as long as removing that many rules may take.
+func reconcileInterface(ctx context.Context, iface string) ([]reconcileAction, error) {
+	var rules []remote.FirewallRule
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		rules, err = readClient.ListRules(ctx, iface)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	removed, _ := reconcileRemovals(rules)
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	// listing again, then deleting every rule
+	ctx, cancel, err := lockStateFor(ctx, cfg.RemoteTimeout*time.Duration(len(removed)+1))
+	if err != nil {
+		return nil, err
+	}
+	defer unlockState()
+	defer cancel()
+	defer invalidateRules(iface)
+
+	// the rules may have changed while we waited for the lock
+	rules, err = client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+	removed, reasons := reconcileRemovals(rules)
+
+	actions := []reconcileAction{}
+	deleteRules := func(ctx context.Context) error {
+		// some remotes identify rules by their position, which deleting
+		// a rule shifts for every rule below it, so go from the bottom up
+		for i := len(removed) - 1; i >= 0; i-- {
+			rule, reason := removed[i], reasons[i]
+
+			log.Println("reconcile: removing rule for", rule.Source(), "via", rule.Gateway(), "on", iface+":", reason)
+			if err := rule.Delete(ctx); err != nil {
+				return err
+			}
+
+			actions = append(actions, reconcileAction{
+				Interface: iface,
+				Reason:    reason,
+				haRule:    toHARules([]remote.FirewallRule{rule})[0],
+			})
+		}
+
+		return nil
+	}
+
+	// apply the filter once for all of them
+	if batchClient, ok := client.(remote.BatchClient); ok {
+		err = batchClient.Batch(ctx, deleteRules)
+	} else {
+		err = deleteRules(ctx)
+	}
+
+	return actions, err
+}
+
+// reconcileRemovals picks the managed rules reconcile removes from
+// rules, in their order, and why
+func reconcileRemovals(rules []remote.FirewallRule) ([]remote.FirewallRule, []string) {
+	slots := map[string]remote.FirewallRule{}
+	removed := []remote.FirewallRule{}
+	reasons := []string{}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Description(), dork) {
+			continue
+		}
+
+		reason := ""
+		if _, err := getGatewayByName(rule.Gateway()); err != nil {
+			reason = "gateway " + rule.Gateway() + " is not configured"
+		} else if kept, found := slots[ruleSlot(rule)]; found {
+			reason = "duplicate of the rule through " + kept.Gateway()
+		} else {
+			slots[ruleSlot(rule)] = rule
+			continue
+		}
+
+		removed = append(removed, rule)
+		reasons = append(reasons, reason)
+	}
+
+	return removed, reasons
+}
+
+// runReconciler reconciles every interval until ctx is done
+func runReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := reconcile(ctx); err != nil {
+			log.Println("error reconciling rules", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func handlerReconcileAPI(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		w.WriteHeader(403)
+		w.Write([]byte("only admins may reconcile rules"))
+		return
+	}
+
+	actions, err := reconcile(r.Context())
+	if err != nil {
+		log.Println("error reconciling rules", err)
+		w.WriteHeader(500)
+		w.Write([]byte("could not reconcile rules"))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(actions)
+}
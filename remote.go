@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
 )
@@ -12,59 +17,579 @@ const deleteDork = "creamy-gateway-delete"
 
 // our connection to the remote client is stateful.
 // we can only be performing one thing at a time.
-var statelock sync.Mutex
+// this is a channel instead of a sync.Mutex so callers can stop
+// waiting when their context is cancelled.
+var statelock = make(chan struct{}, 1)
 
-func getGatewayStatus() ([]remote.Gateway, error) {
-	statelock.Lock()
-	defer statelock.Unlock()
+// lockState waits for the remote client to be free.
+// if it returns nil, the caller must call the returned context's cancel
+// func and then unlockState when finished.
+func lockState(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	return lockStateFor(ctx, cfg.RemoteTimeout)
+}
+
+// lockStateFor is lockState for callers doing more than one operation,
+// which get timeout instead of the usual remote timeout
+func lockStateFor(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, error) {
+	select {
+	case statelock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	// the request may have been cancelled while we were acquiring the lock
+	if err := ctx.Err(); err != nil {
+		unlockState()
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, nil
+}
 
-	return client.ListGateways()
+func unlockState() {
+	<-statelock
 }
 
-func getActiveRule(iface, source string) (remote.FirewallRule, error) {
-	statelock.Lock()
-	defer statelock.Unlock()
+// readPool holds the sessions reads use,
+// nil if they share the session of writes
+var readPool *remote.ClientPool
 
-	rules, err := client.ListRules(iface)
+// withReadClient runs fn with a client to read from: a pooled one if
+// there is a pool, so reads run in parallel, or else the client of
+// writes under the state lock. fn must not change anything through it.
+func withReadClient(ctx context.Context, fn func(ctx context.Context, readClient remote.Client) error) error {
+	if readPool == nil {
+		ctx, cancel, err := lockState(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlockState()
+		defer cancel()
+
+		return fn(ctx, client)
+	}
+
+	readClient, err := readPool.Acquire(ctx)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer readPool.Release(readClient)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.RemoteTimeout)
+	defer cancel()
+
+	return fn(ctx, readClient)
+}
+
+// nameFor returns the gateway that routes family, or an empty
+// string if gw has no counterpart in that family
+func (gw gateway) nameFor(family string) string {
+	if family == remote.FamilyIPv6 {
+		return gw.Name6
+	}
+
+	return gw.Name
+}
+
+func getGatewayStatus(ctx context.Context) ([]remote.Gateway, error) {
+	var gateways []remote.Gateway
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		gateways, err = readClient.ListGateways(ctx)
+		return err
+	})
+
+	return gateways, err
+}
+
+// covers reports whether a rule for ruleSource applies to source.
+// Subnets cover the hosts and narrower subnets inside them, aliases
+// cover what they list.
+func covers(ruleSource, source string, aliases map[string]remote.Alias) bool {
+	if ruleSource == source {
+		return true
+	}
+
+	if _, network, err := net.ParseCIDR(ruleSource); err == nil {
+		if ip := net.ParseIP(source); ip != nil {
+			return network.Contains(ip)
+		}
+
+		if ip, sourceNetwork, err := net.ParseCIDR(source); err == nil {
+			ruleOnes, _ := network.Mask.Size()
+			sourceOnes, _ := sourceNetwork.Mask.Size()
+			return network.Contains(ip) && ruleOnes <= sourceOnes
+		}
+
+		return false
+	}
+
+	if alias, found := aliases[ruleSource]; found {
+		for _, address := range alias.Addresses() {
+			if covers(address, source, nil) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getActiveRule returns the rule that decides the gateway of source:
+// its own rule, or else the most specific subnet or alias rule
+// that covers it, and when the rules it was picked from were listed
+func getActiveRule(ctx context.Context, iface, source string) (remote.FirewallRule, time.Time, error) {
+	if cfg.Mode == modeAlias {
+		rule, err := getActiveAliasRule(ctx, iface, source)
+		return rule, time.Now(), err
 	}
 
+	rules, updated, err := cachedRules(ctx, iface)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ours := []remote.FirewallRule{}
+	hasAliasRules := false
 	for _, rule := range rules {
-		if rule.Source() == source && strings.HasPrefix(rule.Description(), dork) {
-			return rule, nil
+		// destination choices only cover part of the traffic
+		if !strings.HasPrefix(rule.Description(), dork) || !catchAll.matches(rule) {
+			continue
+		}
+
+		ours = append(ours, rule)
+		if rule.Source() != "*" && remote.AddressFamily(rule.Source()) == "" {
+			hasAliasRules = true
+		}
+	}
+
+	// alias members are only looked up when they could matter
+	aliases := map[string]remote.Alias{}
+	if _, ok := client.(remote.AliasClient); ok && hasAliasRules {
+		aliasList, err := listAliases(ctx)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		for _, alias := range aliasList {
+			aliases[alias.Name()] = alias
 		}
 	}
 
-	return nil, nil
+	var active remote.FirewallRule
+	for _, rule := range ours {
+		if !covers(rule.Source(), source, aliases) {
+			continue
+		}
+
+		if active == nil || remote.SourcePrecedence(rule.Source()) < remote.SourcePrecedence(active.Source()) {
+			active = rule
+		}
+	}
+
+	return active, updated, nil
 }
 
-func setGateway(iface, source, gateway, label string) (remote.FirewallRule, error) {
-	statelock.Lock()
-	defer statelock.Unlock()
+func listAliases(ctx context.Context) ([]remote.Alias, error) {
+	var aliases []remote.Alias
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) error {
+		aliasClient, ok := readClient.(remote.AliasClient)
+		if !ok {
+			return errors.New("remote does not support aliases")
+		}
+
+		var err error
+		aliases, err = aliasClient.ListAliases(ctx)
+		return err
+	})
+
+	return aliases, err
+}
 
-	rules, err := client.ListRules(iface)
+// switchError is returned by setGateway when a switch failed
+// after the remote may already have been changed
+type switchError struct {
+	err error
+
+	// rollbackErr is nil if the previous rule was restored
+	rollbackErr error
+}
+
+func (err *switchError) Error() string {
+	if err.rollbackErr != nil {
+		return fmt.Sprintf("%v, and restoring the previous rule failed: %v", err.err, err.rollbackErr)
+	}
+
+	return fmt.Sprintf("%v, the previous rule was restored", err.err)
+}
+
+func (err *switchError) Unwrap() error {
+	return err.err
+}
+
+// restoreRule puts the previous rule back after a failed switch.
+// It gets its own deadline: the failure may have been the caller's
+// context running out, and the rollback must not be abandoned. It
+// keeps the values of ctx, so it is applied along with its batch.
+func restoreRule(ctx context.Context, iface string, previous remote.FirewallRule) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.RemoteTimeout)
+	defer cancel()
+
+	rules, err := client.ListRules(ctx, iface)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// check for old rules, remove them:
 	for _, rule := range rules {
-		if rule.Source() == source && strings.HasPrefix(rule.Description(), dork) {
-			err = rule.Delete()
+		if rule.Source() != previous.Source() || rule.Family() != previous.Family() || !sameDestination(rule, previous) || !strings.HasPrefix(rule.Description(), dork) {
+			continue
+		}
+
+		if rule.Gateway() == previous.Gateway() && rule.Description() == previous.Description() {
+			// the failed step never took effect
+			return nil
+		}
+
+		if updatable, ok := rule.(remote.UpdatableFirewallRule); ok {
+			_, err = updatable.Update(ctx, previous.Gateway(), previous.Description())
+			return err
+		}
+
+		err = rule.Delete(ctx)
+		if err != nil {
+			return err
+		}
+
+		break
+	}
+
+	_, err = client.AddRule(ctx, iface, previous.Family(), previous.Source(), previous.Destination(), previous.Protocol(), previous.Port(), previous.Gateway(), previous.Description())
+	return err
+}
+
+// rollbackKey marks a context whose changes record how to undo them
+// in a *[]func(ctx context.Context) error, in case their batch fails
+// to apply
+type rollbackKey struct{}
+
+// onRollback records undo for the change made through ctx, if its
+// batch may need rolling back
+func onRollback(ctx context.Context, undo func(ctx context.Context) error) {
+	if undos, ok := ctx.Value(rollbackKey{}).(*[]func(ctx context.Context) error); ok {
+		*undos = append(*undos, undo)
+	}
+}
+
+// rollbackRule makes family's traffic from source to dest go where
+// previous sent it, or removes our rule for it if there was none
+func rollbackRule(ctx context.Context, iface, family, source string, dest destination, previous remote.FirewallRule) error {
+	if previous != nil {
+		return restoreRule(ctx, iface, previous)
+	}
+
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if rule.Source() != source || rule.Family() != family || !dest.matches(rule) || !strings.HasPrefix(rule.Description(), dork) {
+			continue
+		}
+
+		if err := rule.Delete(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dualStackSources returns source followed by the addresses its host
+// has in the other family, found by hardware address in the remote's
+// ARP and NDP tables. Remotes without those tables only get source.
+func dualStackSources(ctx context.Context, source string) []string {
+	sources := []string{source}
+
+	if _, ok := client.(remote.NeighbourClient); !ok {
+		return sources
+	}
+
+	sourceIP := net.ParseIP(source)
+	if sourceIP == nil {
+		return sources
+	}
+
+	var neighbours []remote.Neighbour
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		neighbours, err = readClient.(remote.NeighbourClient).ListNeighbours(ctx)
+		return err
+	})
+	if err != nil {
+		log.Println("error listing neighbours of", source, err)
+		return sources
+	}
+
+	hardwareAddress := ""
+	for _, neighbour := range neighbours {
+		if sourceIP.Equal(net.ParseIP(neighbour.Address)) {
+			hardwareAddress = neighbour.HardwareAddress
+			break
+		}
+	}
+	if hardwareAddress == "" {
+		return sources
+	}
+
+	family := remote.AddressFamily(source)
+	for _, neighbour := range neighbours {
+		ip := net.ParseIP(neighbour.Address)
+
+		// link-local addresses never reach a gateway
+		if neighbour.HardwareAddress != hardwareAddress || ip == nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+
+		if remote.AddressFamily(neighbour.Address) != family {
+			sources = append(sources, neighbour.Address)
+		}
+	}
+
+	return sources
+}
+
+// chooseGateway routes the traffic from every address of source's host
+// to dest through gw, each through the gateway of its own family.
+// source may also be a subnet or an alias, which get rules for every
+// family gw handles. Unless until is zero, the choice is reverted then.
+func chooseGateway(ctx context.Context, iface, source string, dest destination, gw gateway, until time.Time) error {
+	job, err := queueChoice(ctx, iface, source, dest, gw, until)
+	if err != nil {
+		return err
+	}
+
+	return job.Wait(ctx)
+}
+
+// queueChoice queues what chooseGateway does and returns right away
+func queueChoice(ctx context.Context, iface, source string, dest destination, gw gateway, until time.Time) (*writeJob, error) {
+	if cfg.Mode == modeAlias {
+		if net.ParseIP(source) == nil {
+			return nil, fmt.Errorf("subnet and alias sources like %v need %v mode", source, modeRule)
+		}
+		if dest != catchAll {
+			return nil, fmt.Errorf("destination choices like %v need %v mode", dest.Name, modeRule)
+		}
+		if !until.IsZero() {
+			return nil, fmt.Errorf("time-limited choices need %v mode", modeRule)
+		}
+	}
+
+	return queueWrite(writeChange{
+		iface:   iface,
+		source:  source,
+		sources: dualStackSources(ctx, source),
+		dest:    dest,
+		gw:      &gw,
+		until:   until,
+	}), nil
+}
+
+// applyChoiceLocked makes the choice of a queued change.
+// The caller must hold the state lock.
+func applyChoiceLocked(ctx context.Context, change writeChange) error {
+	iface, source, sources, dest, gw, until := change.iface, change.source, change.sources, change.dest, *change.gw, change.until
+
+	if cfg.Mode == modeAlias {
+		return setAliasGatewayLocked(ctx, sources, gw.Name)
+	}
+
+	switched := false
+	for _, address := range sources {
+		for _, target := range choiceTargets(address, dest, gw) {
+			if !change.touches(target.family) {
+				continue
+			}
+			if target.gateway == "" {
+				log.Println("gateway", gw.Name, "has no", target.family, "counterpart, leaving", address, "alone")
+				continue
+			}
+
+			_, err := setGatewayLocked(ctx, iface, target.family, address, dest, target.gateway, gw.Label, until)
 			if err != nil {
-				return nil, err
+				return err
 			}
+			switched = true
+		}
+	}
+
+	if !switched {
+		return fmt.Errorf("gateway %v cannot route any address of %v to %v", gw.Name, source, dest.Label)
+	}
+
+	if !until.IsZero() {
+		wakeExpiryScheduler()
+	}
+
+	return nil
+}
+
+// choiceTargets are the families whose traffic from address to dest
+// a choice of gw routes, each with the gateway taking it
+func choiceTargets(address string, dest destination, gw gateway) []familyGateway {
+	family := remote.AddressFamily(address)
+
+	// an IPv4 destination is never reached from an IPv6 address
+	destFamily := remote.AddressFamily(dest.Address)
+	if destFamily != "" && family != "" && destFamily != family {
+		return nil
+	}
+
+	if family == "" && destFamily != "" {
+		return []familyGateway{{destFamily, gw.nameFor(destFamily)}}
+	}
+	if family == "" {
+		// aliases can hold addresses of either family
+		return aliasRuleFamilies(gw)
+	}
 
+	return []familyGateway{{family, gw.nameFor(family)}}
+}
+
+// setGatewayLocked routes family's traffic from source to dest through
+// gateway, or removes the rule doing so if gateway is deleteDork.
+// The caller must hold the state lock.
+func setGatewayLocked(ctx context.Context, iface, family, source string, dest destination, gateway, label string, until time.Time) (remote.FirewallRule, error) {
+	defer invalidateRules(iface)
+
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous remote.FirewallRule
+	for _, rule := range rules {
+		if rule.Source() == source && rule.Family() == family && dest.matches(rule) && strings.HasPrefix(rule.Description(), dork) {
+			previous = rule
 			break
 		}
 	}
 
+	description := dork + " user chose \"" + label + "\" (" + gateway + ")"
+	if dest != catchAll {
+		description += " for \"" + dest.Label + "\""
+	}
+	if !until.IsZero() {
+		description += expirySuffix(until, revertGateway(previous))
+	}
+
+	// nothing to change:
+	if previous == nil && gateway == deleteDork {
+		return nil, nil
+	}
+	if previous != nil && previous.Gateway() == gateway && until.IsZero() {
+		// a time limit is lifted by choosing the same gateway for good
+		if _, _, timed := parseExpiry(previous.Description()); !timed {
+			return previous, nil
+		}
+	}
+
+	onRollback(ctx, func(ctx context.Context) error {
+		return rollbackRule(ctx, iface, family, source, dest, previous)
+	})
+
+	if previous == nil {
+		// nothing to roll back to
+		reportProgress(ctx, jobAdding)
+		rule, err := client.AddRule(ctx, iface, family, source, dest.Address, dest.Protocol, dest.Port, gateway, description)
+		if err != nil {
+			return nil, err
+		}
+
+		resetStates(ctx, source, "", gateway)
+		return rule, nil
+	}
+
+	// editing in place reloads the filter once and never leaves
+	// the source without a rule
+	if updatable, ok := previous.(remote.UpdatableFirewallRule); ok && gateway != deleteDork {
+		reportProgress(ctx, jobAdding)
+		rule, err := updatable.Update(ctx, gateway, description)
+		if err != nil {
+			return nil, &switchError{err, restoreRule(ctx, iface, previous)}
+		}
+
+		resetStates(ctx, source, previous.Gateway(), gateway)
+		return rule, nil
+	}
+
+	reportProgress(ctx, jobDeleting)
+	err = previous.Delete(ctx)
+	if err != nil {
+		// the delete may have gone through before failing
+		return nil, &switchError{err, restoreRule(ctx, iface, previous)}
+	}
+
 	if gateway == deleteDork {
 		return nil, nil
 	}
 
-	// create new rule:
-	description := dork + " user chose \"" + label + "\" (" + gateway + ")"
-	return client.AddRule(iface, source, "*", gateway, description)
+	reportProgress(ctx, jobAdding)
+	rule, err := client.AddRule(ctx, iface, family, source, dest.Address, dest.Protocol, dest.Port, gateway, description)
+	if err != nil {
+		return nil, &switchError{err, restoreRule(ctx, iface, previous)}
+	}
+
+	resetStates(ctx, source, previous.Gateway(), gateway)
+	return rule, nil
+}
+
+// stateReset is a resetStates held back until the change is applied
+type stateReset struct {
+	source          string
+	previousGateway string
+	gateway         string
+}
+
+// stateResetsKey marks a context whose state resets are collected
+// in a *[]stateReset instead of made right away
+type stateResetsKey struct{}
+
+// resetStates drops the states of source after it switched from
+// previousGateway, empty if unknown, to gateway, if gateway asks for
+// it. The switch went through either way, so failures are only logged.
+// Within a batch, states are only dropped once the batch is applied,
+// or connections would reopen through the old gateway before that.
+// The caller must hold the state lock.
+func resetStates(ctx context.Context, source, previousGateway, gateway string) {
+	if resets, ok := ctx.Value(stateResetsKey{}).(*[]stateReset); ok {
+		*resets = append(*resets, stateReset{source, previousGateway, gateway})
+		return
+	}
+
+	gw, err := getGatewayByName(gateway)
+	if err != nil || !gw.KillStates || previousGateway == gateway {
+		return
+	}
+
+	stateClient, ok := client.(remote.StateClient)
+	if !ok {
+		log.Println("remote cannot kill states, leaving those of", source)
+		return
+	}
+
+	if remote.AddressFamily(source) == "" {
+		log.Println("cannot kill states of alias", source)
+		return
+	}
+
+	wan := ""
+	if previous, err := getGatewayByName(previousGateway); err == nil {
+		wan = previous.Interface
+	}
+
+	if err := stateClient.KillStates(ctx, source, wan); err != nil {
+		log.Println("error killing states of", source, err)
+	}
 }
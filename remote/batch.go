@@ -0,0 +1,76 @@
+package remote
+
+import (
+	"context"
+	"sync"
+)
+
+// batchKey marks a context as part of a batch of the client owner
+type batchKey struct {
+	owner interface{}
+}
+
+// pendingApplies collects what a batch held back, like the interfaces
+// whose filter must be applied
+type pendingApplies struct {
+	lock    sync.Mutex
+	pending []string
+}
+
+// deferApply reports whether ctx is part of a batch of owner, and
+// if so records that key must be applied when the batch ends
+func deferApply(ctx context.Context, owner interface{}, key string) bool {
+	applies, ok := ctx.Value(batchKey{owner}).(*pendingApplies)
+	if !ok {
+		return false
+	}
+
+	applies.lock.Lock()
+	defer applies.lock.Unlock()
+
+	for _, pending := range applies.pending {
+		if pending == key {
+			return true
+		}
+	}
+	applies.pending = append(applies.pending, key)
+
+	return true
+}
+
+// runBatch runs fn with the applies of owner held back, then calls
+// apply once with every key held back. Batches of the same owner
+// nest into the outermost one.
+func runBatch(ctx context.Context, owner interface{}, fn func(ctx context.Context) error, apply func(ctx context.Context, keys []string) error) error {
+	if _, ok := ctx.Value(batchKey{owner}).(*pendingApplies); ok {
+		return fn(ctx)
+	}
+
+	applies := &pendingApplies{}
+	err := fn(context.WithValue(ctx, batchKey{owner}, applies))
+
+	// what fn changed before failing must not be left unapplied
+	if len(applies.pending) > 0 {
+		if applyErr := apply(ctx, applies.pending); err == nil {
+			err = applyErr
+		}
+	}
+
+	return err
+}
+
+// batchAll runs fn in a batch of every client that supports them
+func batchAll(ctx context.Context, clients []Client, fn func(ctx context.Context) error) error {
+	if len(clients) == 0 {
+		return fn(ctx)
+	}
+
+	batchClient, ok := clients[0].(BatchClient)
+	if !ok {
+		return batchAll(ctx, clients[1:], fn)
+	}
+
+	return batchClient.Batch(ctx, func(ctx context.Context) error {
+		return batchAll(ctx, clients[1:], fn)
+	})
+}
@@ -1,29 +1,238 @@
 package remote
 
-// FirewallRule from remote interface
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// FamilyIPv4 rules only match IPv4 traffic
+	FamilyIPv4 = "inet"
+	// FamilyIPv6 rules only match IPv6 traffic
+	FamilyIPv6 = "inet6"
+	// FamilyDual rules match both, which only makes sense for
+	// sources like aliases that can hold addresses of either family
+	FamilyDual = "inet46"
+)
+
+// AddressFamily returns the family of an address or subnet,
+// or an empty string if it is neither, like an alias name or "*"
+func AddressFamily(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		var err error
+		ip, _, err = net.ParseCIDR(address)
+		if err != nil {
+			return ""
+		}
+	}
+
+	if ip.To4() != nil && !strings.Contains(address, ":") {
+		return FamilyIPv4
+	}
+
+	return FamilyIPv6
+}
+
+// splitNetwork splits a subnet like "10.0.0.0/24" into its address
+// and prefix length. Hosts and aliases are returned with no length.
+func splitNetwork(address string) (string, string) {
+	if _, _, err := net.ParseCIDR(address); err != nil {
+		return address, ""
+	}
+
+	parts := strings.SplitN(address, "/", 2)
+	return parts[0], parts[1]
+}
+
+// networkOf returns the subnet of address with the given prefix length,
+// like "10.0.0.0/24" for "10.0.0.1" and "24", or an empty string if
+// address is not an IP address, like "dhcp"
+func networkOf(address string, prefixLen string) string {
+	_, network, err := net.ParseCIDR(address + "/" + prefixLen)
+	if err != nil {
+		return ""
+	}
+
+	return network.String()
+}
+
+// protocolFamily reads the family from a Web UI protocol cell like "IPv4+6 TCP"
+func protocolFamily(protocol string) string {
+	switch {
+	case strings.Contains(protocol, "IPv4+6"):
+		return FamilyDual
+	case strings.Contains(protocol, "IPv6"):
+		return FamilyIPv6
+	}
+
+	return FamilyIPv4
+}
+
+// ruleProtocol reads the protocol from a Web UI protocol cell like
+// "IPv4+6 TCP", as "tcp", "udp", "tcp/udp" and so on, or "*" for any
+func ruleProtocol(protocol string) string {
+	fields := strings.Fields(protocol)
+	if len(fields) < 2 || fields[1] == "*" || strings.EqualFold(fields[1], "any") {
+		return "*"
+	}
+
+	return strings.ToLower(fields[1])
+}
+
+// rulePort normalizes a port cell like "1000 - 2000", "*" for any
+func rulePort(port string) string {
+	port = strings.Join(strings.Fields(port), "")
+	if port == "" || strings.EqualFold(port, "any") {
+		return "*"
+	}
+
+	return port
+}
+
+// FirewallRule from remote interface.
+// Protocol and Port use "*" for any, like Source and Destination.
 type FirewallRule interface {
 	Source() string
 	Destination() string
+	Protocol() string
+	// Port is the destination port or range like "1000-2000"
+	Port() string
 	Gateway() string
 	Description() string
+	// Family is FamilyIPv4, FamilyIPv6 or FamilyDual
+	Family() string
 
-	Delete() error
+	Delete(ctx context.Context) error
+}
+
+// UpdatableFirewallRule can change its gateway and description in place,
+// which needs a single filter reload instead of one for Delete and one for AddRule
+type UpdatableFirewallRule interface {
+	FirewallRule
+
+	Update(ctx context.Context, gateway, description string) (FirewallRule, error)
+}
+
+// Alias is a named list of hosts on the remote,
+// usable as a rule source
+type Alias interface {
+	Name() string
+	Description() string
+	Addresses() []string
 }
 
+// GatewayStatus summarises the health of a gateway
+type GatewayStatus string
+
+const (
+	// GatewayOnline is healthy
+	GatewayOnline GatewayStatus = "online"
+	// GatewayDegradedLatency is up, but over its latency threshold
+	GatewayDegradedLatency GatewayStatus = "degraded-latency"
+	// GatewayDegradedLoss is up, but over its packet loss threshold
+	GatewayDegradedLoss GatewayStatus = "degraded-loss"
+	// GatewayPending has not been monitored long enough to tell
+	GatewayPending GatewayStatus = "pending"
+	// GatewayDown is not passing traffic
+	GatewayDown GatewayStatus = "down"
+)
+
 // Gateway configured on remote interface
 type Gateway interface {
 	Name() string
 	Description() string
 
 	GatewayAddress() string
-	RoundtripTime() string
-	Online() bool
+	MonitorAddress() string
+
+	RoundtripTime() time.Duration
+	RoundtripTimeDeviation() time.Duration
+	// PacketLoss in percent
+	PacketLoss() float64
+	Status() GatewayStatus
 }
 
 // Client connects to the remote Web UI
 type Client interface {
-	ListGateways() ([]Gateway, error)
+	ListGateways(ctx context.Context) ([]Gateway, error)
+
+	ListRules(ctx context.Context, iface string) ([]FirewallRule, error)
+	AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (FirewallRule, error)
+}
+
+// Neighbour is an entry of the remote's ARP or NDP table
+type Neighbour struct {
+	Address         string
+	HardwareAddress string
+}
+
+// NeighbourClient can read the remote's ARP and NDP tables,
+// which tie the IPv4 and IPv6 addresses of a host together
+type NeighbourClient interface {
+	Client
+
+	ListNeighbours(ctx context.Context) ([]Neighbour, error)
+}
+
+// Interface is a network the remote routes for
+type Interface struct {
+	Name string
+	// Subnets the interface is addressed in, like "10.0.0.0/24"
+	Subnets []string
+}
+
+// InterfaceClient can list the remote's interfaces and their subnets
+type InterfaceClient interface {
+	Client
+
+	ListInterfaces(ctx context.Context) ([]Interface, error)
+}
+
+// CARPClient can tell whether the remote is the CARP master
+// of its HA group
+type CARPClient interface {
+	Client
+
+	IsMaster(ctx context.Context) (bool, error)
+}
+
+// SyncClient can push its config to the other nodes of its HA group
+type SyncClient interface {
+	Client
+
+	SyncConfig(ctx context.Context) error
+}
+
+// StateClient can drop the firewall states of a source, so its
+// established connections follow a new gateway right away
+type StateClient interface {
+	Client
+
+	// KillStates drops the states from source. If wan is not empty, only
+	// states leaving through that interface are dropped where the remote
+	// can tell them apart, elsewhere every state from source is.
+	KillStates(ctx context.Context, source, wan string) error
+}
+
+// BatchClient can hold back applying changes to its filter,
+// which is the slow part of a change, to apply many at once
+type BatchClient interface {
+	Client
+
+	// Batch runs fn and then applies the changes made through the
+	// context passed to fn, even if fn fails
+	Batch(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// AliasClient can also manage host aliases
+type AliasClient interface {
+	Client
 
-	ListRules(iface string) ([]FirewallRule, error)
-	AddRule(iface, source, destination, gateway, description string) (FirewallRule, error)
+	ListAliases(ctx context.Context) ([]Alias, error)
+	// UpdateAlias replaces the addresses of the named alias,
+	// creating it if it does not exist yet
+	UpdateAlias(ctx context.Context, name, description string, addresses []string) (Alias, error)
 }
@@ -0,0 +1,64 @@
+package remote
+
+import (
+	"net/url"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// formValues collects the values a browser would submit for form,
+// leaving out buttons so the caller can choose which one was "clicked"
+func formValues(form *goquery.Selection) url.Values {
+	values := url.Values{}
+
+	form.Find("input[name]").Each(func(i int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		value, _ := s.Attr("value")
+		inputType, _ := s.Attr("type")
+
+		switch inputType {
+		case "submit", "button", "reset", "image", "file":
+			return
+		case "checkbox", "radio":
+			if _, checked := s.Attr("checked"); !checked {
+				return
+			}
+			if value == "" {
+				value = "on"
+			}
+		}
+
+		if _, disabled := s.Attr("disabled"); disabled {
+			return
+		}
+
+		values.Add(name, value)
+	})
+
+	form.Find("select[name]").Each(func(i int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+
+		selected := s.Find("option[selected]")
+		if selected.Length() == 0 {
+			if _, multiple := s.Attr("multiple"); multiple {
+				return
+			}
+			selected = s.Find("option").First()
+		}
+
+		selected.Each(func(i int, option *goquery.Selection) {
+			value, found := option.Attr("value")
+			if !found {
+				value = option.Text()
+			}
+			values.Add(name, value)
+		})
+	})
+
+	form.Find("textarea[name]").Each(func(i int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		values.Add(name, s.Text())
+	})
+
+	return values
+}
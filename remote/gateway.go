@@ -0,0 +1,45 @@
+package remote
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+func parseGatewayDuration(text string) time.Duration {
+	duration, err := time.ParseDuration(strings.TrimSpace(text))
+	if err != nil {
+		return 0
+	}
+	return duration
+}
+
+func parseGatewayLoss(text string) float64 {
+	loss, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "%")), 64)
+	if err != nil {
+		return 0
+	}
+	return loss
+}
+
+// parseGatewayStatus understands the status texts of the web UIs
+// ("Online", "Warning, Latency", "Offline, Packetloss", "Pending")
+// and of the APIs ("online", "delay", "loss", "down", "none")
+func parseGatewayStatus(text string) GatewayStatus {
+	text = strings.ToLower(text)
+
+	switch {
+	case strings.Contains(text, "offline") || strings.Contains(text, "down"):
+		return GatewayDown
+	case strings.Contains(text, "pending") || strings.Contains(text, "unknown"):
+		return GatewayPending
+	case strings.Contains(text, "loss"):
+		return GatewayDegradedLoss
+	case strings.Contains(text, "latency") || strings.Contains(text, "delay"):
+		return GatewayDegradedLatency
+	case strings.Contains(text, "online") || text == "none":
+		return GatewayOnline
+	}
+
+	return GatewayPending
+}
@@ -0,0 +1,490 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// HAModeSync writes to the master and has it sync its config
+	// to the other nodes
+	HAModeSync = "sync"
+	// HAModeWriteAll writes to every node directly
+	HAModeWriteAll = "write-all"
+)
+
+// haMasterTTL is how long a node found to be master is trusted
+// before asking again
+const haMasterTTL = 30 * time.Second
+
+// RuleDivergence lists how the rules of one node differ from the master's
+type RuleDivergence struct {
+	Host string
+	// Missing rules exist on the master but not on this node
+	Missing []FirewallRule
+	// Extra rules exist on this node but not on the master
+	Extra []FirewallRule
+}
+
+// HAClient manages a group of firewalls, like a CARP pair, as one.
+// Reads go to the current master.
+type HAClient interface {
+	Client
+
+	// Master returns the host of the current master
+	Master(ctx context.Context) (string, error)
+	// Divergence compares the rules of iface on every other node with
+	// the master's. Nodes that match are left out.
+	Divergence(ctx context.Context, iface string) ([]RuleDivergence, error)
+}
+
+type haNode struct {
+	host   string
+	client Client
+}
+
+type haClient struct {
+	nodes []haNode
+	mode  string
+
+	placement Placement
+
+	lock      sync.Mutex
+	master    *haNode
+	checkedAt time.Time
+}
+
+// currentMaster asks the nodes in order which is the CARP master,
+// unless one was found recently
+func (client *haClient) currentMaster(ctx context.Context) (haNode, error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.master != nil && time.Since(client.checkedAt) < haMasterTTL {
+		return *client.master, nil
+	}
+
+	for _, node := range client.nodes {
+		carpClient, ok := node.client.(CARPClient)
+		if !ok {
+			continue
+		}
+
+		master, err := carpClient.IsMaster(ctx)
+		if err != nil {
+			log.Println("error checking CARP status of", node.host, err)
+			continue
+		}
+
+		if master {
+			if client.master == nil || client.master.host != node.host {
+				log.Println("CARP master is", node.host)
+			}
+
+			node := node
+			client.master = &node
+			client.checkedAt = time.Now()
+			return node, nil
+		}
+	}
+
+	client.master = nil
+	return haNode{}, errors.New("no node is CARP master")
+}
+
+// others returns every node but master
+func (client *haClient) others(master haNode) []haNode {
+	others := make([]haNode, 0, len(client.nodes)-1)
+	for _, node := range client.nodes {
+		if node.host != master.host {
+			others = append(others, node)
+		}
+	}
+	return others
+}
+
+// synced triggers the config sync of master after a write in sync mode
+func (client *haClient) synced(ctx context.Context, master haNode) error {
+	if client.mode != HAModeSync {
+		return nil
+	}
+
+	syncClient, ok := master.client.(SyncClient)
+	if !ok {
+		return fmt.Errorf("%v cannot sync its config", master.host)
+	}
+
+	if deferApply(ctx, client, master.host) {
+		return nil
+	}
+
+	return syncClient.SyncConfig(ctx)
+}
+
+// Batch batches fn on every node that supports it. In sync mode,
+// each master written to then syncs its config once.
+func (client *haClient) Batch(ctx context.Context, fn func(ctx context.Context) error) error {
+	clients := make([]Client, len(client.nodes))
+	for i, node := range client.nodes {
+		clients[i] = node.client
+	}
+
+	return runBatch(ctx, client, func(ctx context.Context) error {
+		return batchAll(ctx, clients, fn)
+	}, func(ctx context.Context, hosts []string) error {
+		for _, node := range client.nodes {
+			if !containsHost(hosts, node.host) {
+				continue
+			}
+
+			if err := node.client.(SyncClient).SyncConfig(ctx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, candidate := range hosts {
+		if candidate == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (client *haClient) Master(ctx context.Context) (string, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return master.host, nil
+}
+
+func (client *haClient) ListGateways(ctx context.Context) ([]Gateway, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return master.client.ListGateways(ctx)
+}
+
+// ruleKey identifies a rule across nodes, where ids differ
+func ruleKey(rule FirewallRule) string {
+	return fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v", rule.Family(), rule.Source(), rule.Destination(), rule.Protocol(), rule.Port(), rule.Gateway(), rule.Description())
+}
+
+// counterparts pairs every rule with the rules of the same key on each
+// of the other nodes, which are nil where a node lacks one
+func counterparts(rules []FirewallRule, others [][]FirewallRule) [][]FirewallRule {
+	remaining := make([]map[string][]FirewallRule, len(others))
+	for i, otherRules := range others {
+		remaining[i] = map[string][]FirewallRule{}
+		for _, rule := range otherRules {
+			remaining[i][ruleKey(rule)] = append(remaining[i][ruleKey(rule)], rule)
+		}
+	}
+
+	paired := make([][]FirewallRule, len(rules))
+	for i, rule := range rules {
+		key := ruleKey(rule)
+		for _, byKey := range remaining {
+			if len(byKey[key]) == 0 {
+				paired[i] = append(paired[i], nil)
+				continue
+			}
+
+			paired[i] = append(paired[i], byKey[key][0])
+			byKey[key] = byKey[key][1:]
+		}
+	}
+
+	return paired
+}
+
+func (client *haClient) listOtherRules(ctx context.Context, master haNode, iface string) ([][]FirewallRule, error) {
+	others := client.others(master)
+	otherRules := make([][]FirewallRule, len(others))
+	for i, node := range others {
+		rules, err := node.client.ListRules(ctx, iface)
+		if err != nil {
+			return nil, fmt.Errorf("error listing rules of %v: %v", node.host, err)
+		}
+		otherRules[i] = rules
+	}
+
+	return otherRules, nil
+}
+
+func (client *haClient) ListRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := master.client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	// synced nodes follow the master, only it is written to
+	paired := make([][]FirewallRule, len(rules))
+	if client.mode == HAModeWriteAll {
+		otherRules, err := client.listOtherRules(ctx, master, iface)
+		if err != nil {
+			return nil, err
+		}
+		paired = counterparts(rules, otherRules)
+	}
+
+	wrapped := make([]FirewallRule, len(rules))
+	for i, rule := range rules {
+		wrapped[i] = client.wrapRule(master, rule, paired[i])
+	}
+
+	return wrapped, nil
+}
+
+func (client *haClient) AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (FirewallRule, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rule, err := master.client.AddRule(ctx, iface, family, source, destination, protocol, port, gateway, description)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.mode == HAModeSync {
+		return client.wrapRule(master, rule, nil), client.synced(ctx, master)
+	}
+
+	added := []FirewallRule{}
+	for _, node := range client.others(master) {
+		counterpart, err := node.client.AddRule(ctx, iface, family, source, destination, protocol, port, gateway, description)
+		if err != nil {
+			// leave no node with a rule the others lack
+			for _, rule := range append(added, rule) {
+				if deleteErr := rule.Delete(ctx); deleteErr != nil {
+					log.Println("error removing partially added rule for", source, deleteErr)
+				}
+			}
+
+			return nil, fmt.Errorf("error adding rule on %v: %v", node.host, err)
+		}
+
+		added = append(added, counterpart)
+	}
+
+	return client.wrapRule(master, rule, added), nil
+}
+
+func (client *haClient) masterAliasClient(ctx context.Context) (haNode, AliasClient, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return haNode{}, nil, err
+	}
+
+	aliasClient, ok := master.client.(AliasClient)
+	if !ok {
+		return haNode{}, nil, fmt.Errorf("%v does not support aliases", master.host)
+	}
+
+	return master, aliasClient, nil
+}
+
+func (client *haClient) ListAliases(ctx context.Context) ([]Alias, error) {
+	_, aliasClient, err := client.masterAliasClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return aliasClient.ListAliases(ctx)
+}
+
+func (client *haClient) UpdateAlias(ctx context.Context, name, description string, addresses []string) (Alias, error) {
+	master, aliasClient, err := client.masterAliasClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	alias, err := aliasClient.UpdateAlias(ctx, name, description, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.mode == HAModeSync {
+		return alias, client.synced(ctx, master)
+	}
+
+	for _, node := range client.others(master) {
+		aliasClient, ok := node.client.(AliasClient)
+		if !ok {
+			return nil, fmt.Errorf("%v does not support aliases", node.host)
+		}
+
+		if _, err := aliasClient.UpdateAlias(ctx, name, description, addresses); err != nil {
+			return nil, fmt.Errorf("error updating alias on %v: %v", node.host, err)
+		}
+	}
+
+	return alias, nil
+}
+
+func (client *haClient) ListNeighbours(ctx context.Context) ([]Neighbour, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbourClient, ok := master.client.(NeighbourClient)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot list neighbours", master.host)
+	}
+
+	return neighbourClient.ListNeighbours(ctx)
+}
+
+func (client *haClient) ListInterfaces(ctx context.Context) ([]Interface, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaceClient, ok := master.client.(InterfaceClient)
+	if !ok {
+		return nil, fmt.Errorf("%v cannot list interfaces", master.host)
+	}
+
+	return interfaceClient.ListInterfaces(ctx)
+}
+
+// KillStates drops the states on every node, the backups may
+// hold them too if states are synced
+func (client *haClient) KillStates(ctx context.Context, source, wan string) error {
+	for _, node := range client.nodes {
+		stateClient, ok := node.client.(StateClient)
+		if !ok {
+			return fmt.Errorf("%v cannot kill states", node.host)
+		}
+
+		if err := stateClient.KillStates(ctx, source, wan); err != nil {
+			return fmt.Errorf("error killing states on %v: %v", node.host, err)
+		}
+	}
+
+	return nil
+}
+
+func (client *haClient) SetPlacement(placement Placement) error {
+	for _, node := range client.nodes {
+		placementClient, ok := node.client.(PlacementClient)
+		if !ok {
+			return fmt.Errorf("%v decides rule placement itself", node.host)
+		}
+
+		if err := placementClient.SetPlacement(placement); err != nil {
+			return err
+		}
+	}
+
+	client.placement = placement
+	return nil
+}
+
+func (client *haClient) Divergence(ctx context.Context, iface string) ([]RuleDivergence, error) {
+	master, err := client.currentMaster(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// with a prefix set, only the rules we manage are compared
+	compared := func(rules []FirewallRule) []FirewallRule {
+		if client.placement.Prefix == "" {
+			return rules
+		}
+
+		managed := []FirewallRule{}
+		for _, rule := range rules {
+			if client.placement.managed(rule) {
+				managed = append(managed, rule)
+			}
+		}
+		return managed
+	}
+
+	rules, err := master.client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+	rules = compared(rules)
+
+	divergences := []RuleDivergence{}
+	for _, node := range client.others(master) {
+		nodeRules, err := node.client.ListRules(ctx, iface)
+		if err != nil {
+			return nil, fmt.Errorf("error listing rules of %v: %v", node.host, err)
+		}
+		nodeRules = compared(nodeRules)
+
+		divergence := RuleDivergence{Host: node.host}
+		for i, paired := range counterparts(rules, [][]FirewallRule{nodeRules}) {
+			if paired[0] == nil {
+				divergence.Missing = append(divergence.Missing, rules[i])
+			}
+		}
+		for i, paired := range counterparts(nodeRules, [][]FirewallRule{rules}) {
+			if paired[0] == nil {
+				divergence.Extra = append(divergence.Extra, nodeRules[i])
+			}
+		}
+
+		if len(divergence.Missing) > 0 || len(divergence.Extra) > 0 {
+			divergences = append(divergences, divergence)
+		}
+	}
+
+	return divergences, nil
+}
+
+// NewHAClient returns a remote.Client that manages the given nodes as
+// one, reading from whichever is CARP master. hosts names the nodes
+// in reports. In HAModeSync the nodes must be able to sync their config.
+func NewHAClient(hosts []string, clients []Client, mode string) (Client, error) {
+	if len(hosts) != len(clients) {
+		return nil, errors.New("every HA node needs a host")
+	}
+
+	if mode != HAModeSync && mode != HAModeWriteAll {
+		return nil, fmt.Errorf("unknown HA mode %v", mode)
+	}
+
+	client := &haClient{
+		mode:      mode,
+		placement: DefaultPlacement,
+	}
+
+	for i, nodeClient := range clients {
+		if _, ok := nodeClient.(CARPClient); !ok {
+			return nil, fmt.Errorf("%v cannot report its CARP status", hosts[i])
+		}
+
+		if _, ok := nodeClient.(SyncClient); !ok && mode == HAModeSync {
+			return nil, fmt.Errorf("%v cannot sync its config, use %v", hosts[i], HAModeWriteAll)
+		}
+
+		client.nodes = append(client.nodes, haNode{hosts[i], nodeClient})
+	}
+
+	return client, nil
+}
@@ -0,0 +1,77 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+)
+
+// haFirewallRule is a rule of the master along with its counterparts
+// on the other nodes, nil where a node lacks one. In sync mode
+// there are none, the master syncs its changes instead.
+type haFirewallRule struct {
+	FirewallRule
+
+	counterparts []FirewallRule
+	master       haNode
+	client       *haClient
+}
+
+// haUpdatableFirewallRule is a haFirewallRule whose master rule
+// and counterparts can all be updated in place
+type haUpdatableFirewallRule struct {
+	*haFirewallRule
+}
+
+func (client *haClient) wrapRule(master haNode, rule FirewallRule, counterparts []FirewallRule) FirewallRule {
+	wrapped := &haFirewallRule{rule, counterparts, master, client}
+
+	if _, ok := rule.(UpdatableFirewallRule); !ok {
+		return wrapped
+	}
+	for _, counterpart := range counterparts {
+		if _, ok := counterpart.(UpdatableFirewallRule); counterpart != nil && !ok {
+			return wrapped
+		}
+	}
+
+	return &haUpdatableFirewallRule{wrapped}
+}
+
+func (rule *haFirewallRule) Delete(ctx context.Context) error {
+	if err := rule.FirewallRule.Delete(ctx); err != nil {
+		return err
+	}
+
+	for i, counterpart := range rule.counterparts {
+		if counterpart == nil {
+			continue
+		}
+
+		if err := counterpart.Delete(ctx); err != nil {
+			return fmt.Errorf("error deleting rule on %v: %v", rule.client.others(rule.master)[i].host, err)
+		}
+	}
+
+	return rule.client.synced(ctx, rule.master)
+}
+
+func (rule *haUpdatableFirewallRule) Update(ctx context.Context, gateway, description string) (FirewallRule, error) {
+	updated, err := rule.FirewallRule.(UpdatableFirewallRule).Update(ctx, gateway, description)
+	if err != nil {
+		return nil, err
+	}
+
+	counterparts := make([]FirewallRule, len(rule.counterparts))
+	for i, counterpart := range rule.counterparts {
+		if counterpart == nil {
+			continue
+		}
+
+		counterparts[i], err = counterpart.(UpdatableFirewallRule).Update(ctx, gateway, description)
+		if err != nil {
+			return nil, fmt.Errorf("error updating rule on %v: %v", rule.client.others(rule.master)[i].host, err)
+		}
+	}
+
+	return rule.client.wrapRule(rule.master, updated, counterparts), rule.client.synced(ctx, rule.master)
+}
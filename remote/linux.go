@@ -0,0 +1,967 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// LinuxModeIPRule selects routing tables with "ip rule" entries
+	LinuxModeIPRule = "iprule"
+	// LinuxModeNftables sets packet marks with nftables rules,
+	// which the administrator maps to routing tables with "ip rule fwmark"
+	LinuxModeNftables = "nftables"
+)
+
+// the nftables chain our mark rules live in, managed by the administrator:
+//
+//	table inet creamy_gateway {
+//		chain prerouting {
+//			type filter hook prerouting priority mangle;
+//		}
+//	}
+const linuxNftTable = "creamy_gateway"
+const linuxNftChain = "prerouting"
+
+// how many ip rule priorities after RulePriority belong to us
+const linuxRulePriorityRange = 1000
+
+// LinuxConfig describes how a Linux router maps gateways to routing
+type LinuxConfig struct {
+	// Mode is LinuxModeIPRule or LinuxModeNftables
+	Mode string
+
+	// Tables maps gateway names to routing table IDs.
+	// In nftables mode the table ID doubles as the packet mark.
+	Tables map[string]string
+
+	// RulePriority is the first ip rule priority we manage
+	RulePriority int
+
+	// StateFile keeps the descriptions of our ip rules, which cannot
+	// carry one themselves, across restarts. Empty keeps them in memory.
+	StateFile string
+
+	// RestoredDescription is reported for our ip rules whose description
+	// was not kept, like rules created by hand
+	RestoredDescription string
+}
+
+// linuxStoredRule is the description of an ip rule we created, along with
+// what the rule matched, so a different rule that later took its
+// priority is not mistaken for it
+type linuxStoredRule struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+}
+
+type linuxClient struct {
+	executor Executor
+	config   LinuxConfig
+
+	// ip rule priority -> description, for rules we created
+	descriptionLock  sync.Mutex
+	descriptions     map[int]linuxStoredRule
+	descriptionsRead bool
+}
+
+type linuxRoute struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway"`
+	Dev     string `json:"dev"`
+}
+
+type linuxAddressInfo struct {
+	Family    string `json:"family"`
+	Local     string `json:"local"`
+	PrefixLen int    `json:"prefixlen"`
+	Scope     string `json:"scope"`
+}
+
+type linuxLink struct {
+	IfName   string             `json:"ifname"`
+	AddrInfo []linuxAddressInfo `json:"addr_info"`
+}
+
+type linuxNeighbour struct {
+	Dst    string   `json:"dst"`
+	Dev    string   `json:"dev"`
+	LLAddr string   `json:"lladdr"`
+	State  []string `json:"state"`
+}
+
+type linuxIPRule struct {
+	Family   string `json:"-"`
+	Priority int    `json:"priority"`
+	Src      string `json:"src"`
+	SrcLen   int    `json:"srclen"`
+	Dst      string `json:"dst"`
+	DstLen   int    `json:"dstlen"`
+	IIf      string `json:"iif"`
+	Table    string `json:"table"`
+
+	IPProto    string `json:"ipproto"`
+	DPort      int    `json:"dport"`
+	DPortStart int    `json:"dport_start"`
+	DPortEnd   int    `json:"dport_end"`
+}
+
+// linuxIPRuleMatch describes what an ip rule matches, as stored with its description
+func linuxIPRuleMatch(family, iface, source, destination, protocol, port, table string) string {
+	return strings.Join([]string{family, iface, source, destination, protocol, port, table}, " ")
+}
+
+func (rawRule linuxIPRule) match() string {
+	return linuxIPRuleMatch(rawRule.Family, rawRule.IIf, rawRule.source(), rawRule.destination(), linuxProtocol(rawRule.IPProto), rawRule.port(), rawRule.Table)
+}
+
+func (rawRule linuxIPRule) source() string {
+	return linuxAddress(rawRule.Src, rawRule.SrcLen)
+}
+
+func (rawRule linuxIPRule) destination() string {
+	return linuxAddress(rawRule.Dst, rawRule.DstLen)
+}
+
+func (rawRule linuxIPRule) precedence() int {
+	return RulePrecedence(rawRule.source(), rawRule.destination(), linuxProtocol(rawRule.IPProto), rawRule.port())
+}
+
+// port formats the destination port match, "*" if there is none
+func (rawRule linuxIPRule) port() string {
+	switch {
+	case rawRule.DPort != 0:
+		return strconv.Itoa(rawRule.DPort)
+	case rawRule.DPortStart != 0:
+		return strconv.Itoa(rawRule.DPortStart) + "-" + strconv.Itoa(rawRule.DPortEnd)
+	}
+
+	return "*"
+}
+
+type linuxNftOutput struct {
+	Nftables []struct {
+		Rule *linuxNftRule `json:"rule"`
+	} `json:"nftables"`
+}
+
+type linuxNftRule struct {
+	Handle  int               `json:"handle"`
+	Comment string            `json:"comment"`
+	Expr    []json.RawMessage `json:"expr"`
+}
+
+type linuxNftMatch struct {
+	Match *struct {
+		Left struct {
+			Meta *struct {
+				Key string `json:"key"`
+			} `json:"meta"`
+			Payload *struct {
+				Protocol string `json:"protocol"`
+				Field    string `json:"field"`
+			} `json:"payload"`
+		} `json:"left"`
+		Right json.RawMessage `json:"right"`
+	} `json:"match"`
+	Mangle *struct {
+		Key struct {
+			Meta *struct {
+				Key string `json:"key"`
+			} `json:"meta"`
+		} `json:"key"`
+		Value json.RawMessage `json:"value"`
+	} `json:"mangle"`
+}
+
+// readDescriptionsLocked loads the state file once, descriptionLock must be held
+func (client *linuxClient) readDescriptionsLocked() error {
+	if client.descriptionsRead || client.config.StateFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(client.config.StateFile)
+	if os.IsNotExist(err) {
+		client.descriptionsRead = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	descriptions := map[int]linuxStoredRule{}
+	if err := json.NewDecoder(file).Decode(&descriptions); err != nil {
+		return fmt.Errorf("unable to read %v: %v", client.config.StateFile, err)
+	}
+
+	client.descriptions = descriptions
+	client.descriptionsRead = true
+
+	return nil
+}
+
+// writeDescriptionsLocked replaces the state file, descriptionLock must be held
+func (client *linuxClient) writeDescriptionsLocked() error {
+	if client.config.StateFile == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(client.config.StateFile), 0755); err != nil {
+		return err
+	}
+
+	temporary := client.config.StateFile + ".tmp"
+	file, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(file).Encode(client.descriptions); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, client.config.StateFile)
+}
+
+// storeDescription keeps the description of the rule at priority,
+// an empty match forgets it
+func (client *linuxClient) storeDescription(priority int, match, description string) error {
+	client.descriptionLock.Lock()
+	defer client.descriptionLock.Unlock()
+
+	if err := client.readDescriptionsLocked(); err != nil {
+		return err
+	}
+
+	if match == "" {
+		if _, found := client.descriptions[priority]; !found {
+			return nil
+		}
+		delete(client.descriptions, priority)
+	} else {
+		client.descriptions[priority] = linuxStoredRule{
+			Rule:        match,
+			Description: description,
+		}
+	}
+
+	return client.writeDescriptionsLocked()
+}
+
+func (client *linuxClient) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return client.executor.Run(ctx, name, args...)
+}
+
+func (client *linuxClient) runJSON(ctx context.Context, v interface{}, name string, args ...string) error {
+	output, err := client.run(ctx, name, args...)
+	if err != nil {
+		return err
+	}
+
+	if len(output) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(output, v)
+}
+
+func (client *linuxClient) gatewayForTable(table string) string {
+	for name, gatewayTable := range client.config.Tables {
+		if gatewayTable == table {
+			return name
+		}
+	}
+
+	return table
+}
+
+func (client *linuxClient) ListGateways(ctx context.Context) ([]Gateway, error) {
+	names := make([]string, 0, len(client.config.Tables))
+	for name := range client.config.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gateways := []Gateway{}
+
+	for _, name := range names {
+		table := client.config.Tables[name]
+		gateway := &linuxGateway{
+			name:  name,
+			table: table,
+		}
+
+		routes := []linuxRoute{}
+		err := client.runJSON(ctx, &routes, "ip", "-j", "route", "show", "table", table, "default")
+		if err != nil {
+			return nil, err
+		}
+
+		if len(routes) > 0 {
+			gateway.gateway = routes[0].Gateway
+			gateway.dev = routes[0].Dev
+			gateway.state = "no neighbour"
+			gateway.status = GatewayPending
+		} else {
+			gateway.state = "no route"
+			gateway.status = GatewayDown
+		}
+
+		if gateway.gateway != "" {
+			neighbours := []linuxNeighbour{}
+			err = client.runJSON(ctx, &neighbours, "ip", "-j", "neigh", "show", "to", gateway.gateway, "dev", gateway.dev)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(neighbours) > 0 && len(neighbours[0].State) > 0 {
+				gateway.state = neighbours[0].State[0]
+
+				switch gateway.state {
+				case "FAILED", "INCOMPLETE":
+					gateway.status = GatewayDown
+				case "NONE":
+					gateway.status = GatewayPending
+				default:
+					gateway.status = GatewayOnline
+				}
+			}
+		} else if gateway.dev != "" {
+			// point-to-point links have no next hop to resolve
+			gateway.state = "point-to-point"
+			gateway.status = GatewayOnline
+		}
+
+		gateways = append(gateways, gateway)
+	}
+
+	return gateways, nil
+}
+
+// flushRouteCache makes routes cached before a rule change follow it.
+// The change is made either way, so a failure is only logged: failing
+// it would leave the rule behind as if it had not been changed.
+func (client *linuxClient) flushRouteCache(ctx context.Context, flag string) {
+	if _, err := client.run(ctx, "ip", flag, "route", "flush", "cache"); err != nil {
+		log.Println("error flushing the route cache, cached routes may ignore the rule change", err)
+	}
+}
+
+// linuxAddress turns an address and prefix length listed by ip into
+// a rule source, a host if the prefix covers the whole address
+func linuxAddress(address string, length int) string {
+	if address == "" || address == "all" {
+		return "*"
+	}
+
+	hostLength := 128
+	if AddressFamily(address) == FamilyIPv4 {
+		hostLength = 32
+	}
+
+	if length != 0 && length != hostLength {
+		return address + "/" + strconv.Itoa(length)
+	}
+
+	return address
+}
+
+// linuxFamilyFlag selects the address family of an ip command
+func linuxFamilyFlag(family string) (string, error) {
+	switch family {
+	case FamilyIPv4:
+		return "-4", nil
+	case FamilyIPv6:
+		return "-6", nil
+	}
+
+	return "", fmt.Errorf("ip rules are per address family, %v is not supported", family)
+}
+
+// ipRules lists our rules of both families.
+// Priorities are shared between the families so they stay unique.
+func (client *linuxClient) ipRules(ctx context.Context) ([]linuxIPRule, error) {
+	ours := []linuxIPRule{}
+
+	for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+		flag, _ := linuxFamilyFlag(family)
+
+		rawRules := []linuxIPRule{}
+		err := client.runJSON(ctx, &rawRules, "ip", flag, "-j", "rule", "show")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rawRule := range rawRules {
+			if rawRule.Priority < client.config.RulePriority || rawRule.Priority >= client.config.RulePriority+linuxRulePriorityRange {
+				continue
+			}
+			rawRule.Family = family
+			ours = append(ours, rawRule)
+		}
+	}
+
+	return ours, nil
+}
+
+func (client *linuxClient) listIPRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	rawRules, err := client.ipRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client.descriptionLock.Lock()
+	defer client.descriptionLock.Unlock()
+
+	if err := client.readDescriptionsLocked(); err != nil {
+		return nil, err
+	}
+
+	rules := []FirewallRule{}
+	for _, rawRule := range rawRules {
+		if rawRule.IIf != iface {
+			continue
+		}
+
+		description := client.config.RestoredDescription
+		if stored, found := client.descriptions[rawRule.Priority]; found && stored.Rule == rawRule.match() {
+			description = stored.Description
+		}
+
+		rules = append(rules, &linuxFirewallRule{
+			id:          strconv.Itoa(rawRule.Priority),
+			iface:       iface,
+			source:      rawRule.source(),
+			destination: rawRule.destination(),
+			protocol:    linuxProtocol(rawRule.IPProto),
+			port:        rawRule.port(),
+			gateway:     client.gatewayForTable(rawRule.Table),
+			description: description,
+			family:      rawRule.Family,
+
+			client: client,
+		})
+	}
+
+	return rules, nil
+}
+
+func (client *linuxClient) nftRules(ctx context.Context) ([]linuxNftRule, error) {
+	output := linuxNftOutput{}
+	err := client.runJSON(ctx, &output, "nft", "-j", "list", "chain", "inet", linuxNftTable, linuxNftChain)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []linuxNftRule{}
+	for _, item := range output.Nftables {
+		if item.Rule != nil {
+			rules = append(rules, *item.Rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func linuxProtocol(protocol string) string {
+	if protocol == "" {
+		return "*"
+	}
+
+	return protocol
+}
+
+func linuxNftValue(raw json.RawMessage) string {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value
+	}
+
+	// port ranges are {"range": [1000, 2000]}, sets are {"set": ["tcp", "udp"]}
+	var collection struct {
+		Range []json.RawMessage `json:"range"`
+		Set   []json.RawMessage `json:"set"`
+	}
+	if err := json.Unmarshal(raw, &collection); err == nil {
+		if len(collection.Range) == 2 {
+			return linuxNftValue(collection.Range[0]) + "-" + linuxNftValue(collection.Range[1])
+		}
+
+		if len(collection.Set) > 0 {
+			values := make([]string, len(collection.Set))
+			for i, item := range collection.Set {
+				values[i] = linuxNftValue(item)
+			}
+			return strings.Join(values, "/")
+		}
+	}
+
+	// prefixes are encoded as {"prefix": {"addr": "10.0.0.0", "len": 24}}
+	var prefix struct {
+		Prefix struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if err := json.Unmarshal(raw, &prefix); err == nil && prefix.Prefix.Addr != "" {
+		return linuxAddress(prefix.Prefix.Addr, prefix.Prefix.Len)
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number.String()
+	}
+
+	return string(raw)
+}
+
+func (client *linuxClient) listNftRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	rawRules, err := client.nftRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []FirewallRule{}
+	for _, rawRule := range rawRules {
+		rule := &linuxFirewallRule{
+			id:          strconv.Itoa(rawRule.Handle),
+			source:      "*",
+			destination: "*",
+			protocol:    "*",
+			port:        "*",
+			description: rawRule.Comment,
+			// without an address match the rule applies to both families
+			family: FamilyDual,
+
+			client: client,
+		}
+
+		for _, rawExpr := range rawRule.Expr {
+			expr := linuxNftMatch{}
+			if err := json.Unmarshal(rawExpr, &expr); err != nil {
+				return nil, err
+			}
+
+			if expr.Match != nil && expr.Match.Left.Meta != nil {
+				switch expr.Match.Left.Meta.Key {
+				case "iifname":
+					rule.iface = linuxNftValue(expr.Match.Right)
+				case "l4proto":
+					rule.protocol = linuxNftValue(expr.Match.Right)
+				}
+			}
+
+			if expr.Match != nil && expr.Match.Left.Payload != nil {
+				switch expr.Match.Left.Payload.Protocol {
+				case "ip":
+					rule.family = FamilyIPv4
+				case "ip6":
+					rule.family = FamilyIPv6
+				}
+
+				switch expr.Match.Left.Payload.Field {
+				case "dport":
+					// "tcp dport" implies the protocol, "th dport" follows an l4proto match
+					if expr.Match.Left.Payload.Protocol != "th" {
+						rule.protocol = expr.Match.Left.Payload.Protocol
+					}
+					rule.port = linuxNftValue(expr.Match.Right)
+				case "saddr":
+					rule.source = linuxNftValue(expr.Match.Right)
+				case "daddr":
+					rule.destination = linuxNftValue(expr.Match.Right)
+				}
+			}
+
+			if expr.Mangle != nil && expr.Mangle.Key.Meta != nil && expr.Mangle.Key.Meta.Key == "mark" {
+				rule.gateway = client.gatewayForTable(linuxNftValue(expr.Mangle.Value))
+			}
+		}
+
+		if rule.iface != iface {
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (client *linuxClient) ListRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	switch client.config.Mode {
+	case LinuxModeIPRule:
+		return client.listIPRules(ctx, iface)
+	case LinuxModeNftables:
+		return client.listNftRules(ctx, iface)
+	}
+
+	return nil, fmt.Errorf("unknown linux mode %v", client.config.Mode)
+}
+
+// priorityBand returns the priorities [first, end) for rules with the
+// given RulePrecedence. Lower priorities are matched first, so hosts get
+// the lower half of our range, destination rules before catch-alls, and
+// everything else the upper half.
+func (client *linuxClient) priorityBand(precedence int) (int, int) {
+	first := client.config.RulePriority
+	quarter := linuxRulePriorityRange / 4
+
+	switch precedence {
+	case 0:
+		return first, first + quarter
+	case 1:
+		return first + quarter, first + 2*quarter
+	}
+
+	return first + 2*quarter, first + linuxRulePriorityRange
+}
+
+// nextPriority finds a free priority for a rule with the given
+// RulePrecedence. Within the upper band the new rule goes between the
+// more specific rules and the wider ones, narrow subnets before wide.
+func (client *linuxClient) nextPriority(ctx context.Context, precedence int) (int, error) {
+	rawRules, err := client.ipRules(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	first, end := client.priorityBand(precedence)
+	lowest, highest := first, end
+
+	used := make(map[int]bool, len(rawRules))
+	for _, rawRule := range rawRules {
+		used[rawRule.Priority] = true
+
+		if rawRule.Priority < first || rawRule.Priority >= end {
+			continue
+		}
+
+		switch other := rawRule.precedence(); {
+		case other < precedence && rawRule.Priority >= lowest:
+			lowest = rawRule.Priority + 1
+		case other > precedence && rawRule.Priority < highest:
+			highest = rawRule.Priority
+		}
+	}
+
+	// the upper band is spread out by precedence, so rules added later
+	// still fit in between
+	preferred := first
+	if precedence > 1 {
+		preferred += precedence
+	}
+	if preferred >= end {
+		preferred = end - 1
+	}
+
+	for priority := preferred; priority < highest; priority++ {
+		if priority >= lowest && !used[priority] {
+			return priority, nil
+		}
+	}
+	for priority := preferred - 1; priority >= lowest; priority-- {
+		if priority < highest && !used[priority] {
+			return priority, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free ip rule priority left between %d and %d for this kind of rule", first, end-1)
+}
+
+func (client *linuxClient) addIPRule(ctx context.Context, iface, family, source, destination, protocol, port, table, description string) (FirewallRule, error) {
+	flag, err := linuxFamilyFlag(family)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(protocol, "/") {
+		return nil, fmt.Errorf("ip rules match a single protocol, not %v", protocol)
+	}
+
+	priority, err := client.nextPriority(ctx, RulePrecedence(source, destination, protocol, port))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{flag, "rule", "add", "priority", strconv.Itoa(priority)}
+	if source != "*" {
+		args = append(args, "from", source)
+	}
+	if destination != "*" {
+		args = append(args, "to", destination)
+	}
+	if protocol != "*" {
+		args = append(args, "ipproto", protocol)
+	}
+	if port != "*" {
+		args = append(args, "dport", port)
+	}
+	args = append(args, "iif", iface, "lookup", table)
+
+	// kept first, a rule without its description would be reported as restored
+	if err := client.storeDescription(priority, linuxIPRuleMatch(family, iface, source, destination, protocol, port, table), description); err != nil {
+		return nil, err
+	}
+
+	if _, err := client.run(ctx, "ip", args...); err != nil {
+		client.storeDescription(priority, "", "")
+		return nil, err
+	}
+
+	client.flushRouteCache(ctx, flag)
+
+	return &linuxFirewallRule{
+		id:          strconv.Itoa(priority),
+		iface:       iface,
+		source:      source,
+		destination: destination,
+		protocol:    protocol,
+		port:        port,
+		gateway:     client.gatewayForTable(table),
+		description: description,
+		family:      family,
+
+		client: client,
+	}, nil
+}
+
+// linuxNftString quotes value for the nft parser, which has no escape
+// sequences: double quotes cannot be part of a string and are dropped
+func linuxNftString(value string) string {
+	return `"` + strings.Replace(value, `"`, "", -1) + `"`
+}
+
+func (client *linuxClient) addNftRule(ctx context.Context, iface, family, source, destination, protocol, port, table, description string) (FirewallRule, error) {
+	var addressProtocol string
+	switch family {
+	case FamilyIPv4:
+		addressProtocol = "ip"
+	case FamilyIPv6:
+		addressProtocol = "ip6"
+	case FamilyDual:
+		if source != "*" || destination != "*" {
+			return nil, errors.New("nftables rules for both families cannot match an address")
+		}
+	default:
+		return nil, fmt.Errorf("unknown address family %v", family)
+	}
+
+	existing, err := client.listNftRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	// every matching rule sets the mark and the last one wins, so wide
+	// sources go first and the new rule goes before the first rule that
+	// is at least as specific
+	args := []string{"add", "rule", "inet", linuxNftTable, linuxNftChain}
+	precedence := RulePrecedence(source, destination, protocol, port)
+	for _, rule := range existing {
+		if rulePrecedence(rule) <= precedence {
+			args = []string{"insert", "rule", "inet", linuxNftTable, linuxNftChain, "position", rule.(*linuxFirewallRule).id}
+			break
+		}
+	}
+
+	args = append(args, "iifname", linuxNftString(iface))
+	if source != "*" {
+		args = append(args, addressProtocol, "saddr", source)
+	}
+	if destination != "*" {
+		args = append(args, addressProtocol, "daddr", destination)
+	}
+	switch {
+	case protocol != "*" && port != "*" && !strings.Contains(protocol, "/"):
+		args = append(args, protocol, "dport", port)
+	case protocol != "*":
+		args = append(args, "meta", "l4proto", "{", strings.Replace(protocol, "/", ", ", -1), "}")
+		if port != "*" {
+			args = append(args, "th", "dport", port)
+		}
+	case port != "*":
+		return nil, errors.New("nftables port matches need a protocol")
+	}
+	comment := linuxNftString(description)
+	args = append(args, "meta", "mark", "set", table, "comment", comment)
+
+	if _, err := client.run(ctx, "nft", args...); err != nil {
+		return nil, err
+	}
+
+	rules, err := client.listNftRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := client.gatewayForTable(table)
+	for _, rule := range rules {
+		if rule.Source() == source && rule.Gateway() == gateway && rule.Destination() == destination && rule.Protocol() == protocol && rule.Port() == port && linuxNftString(rule.Description()) == comment && rule.Family() == family {
+			return rule, nil
+		}
+	}
+
+	return nil, errors.New("unable to find created rule")
+}
+
+func (client *linuxClient) AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (FirewallRule, error) {
+	table, found := client.config.Tables[gateway]
+	if !found {
+		return nil, fmt.Errorf("no routing table configured for gateway %v", gateway)
+	}
+
+	if source != "*" && AddressFamily(source) == "" {
+		return nil, fmt.Errorf("linux has no aliases, cannot add a rule for %v", source)
+	}
+
+	switch client.config.Mode {
+	case LinuxModeIPRule:
+		return client.addIPRule(ctx, iface, family, source, destination, protocol, port, table, description)
+	case LinuxModeNftables:
+		return client.addNftRule(ctx, iface, family, source, destination, protocol, port, table, description)
+	}
+
+	return nil, fmt.Errorf("unknown linux mode %v", client.config.Mode)
+}
+
+func (client *linuxClient) deleteRule(ctx context.Context, family, id string) error {
+	switch client.config.Mode {
+	case LinuxModeIPRule:
+		flag, err := linuxFamilyFlag(family)
+		if err != nil {
+			return err
+		}
+
+		if _, err := client.run(ctx, "ip", flag, "rule", "del", "priority", id); err != nil {
+			return err
+		}
+
+		if priority, err := strconv.Atoi(id); err == nil {
+			if err := client.storeDescription(priority, "", ""); err != nil {
+				return err
+			}
+		}
+
+		client.flushRouteCache(ctx, flag)
+		return nil
+	case LinuxModeNftables:
+		_, err := client.run(ctx, "nft", "delete", "rule", "inet", linuxNftTable, linuxNftChain, "handle", id)
+		return err
+	}
+
+	return fmt.Errorf("unknown linux mode %v", client.config.Mode)
+}
+
+func (client *linuxClient) ListNeighbours(ctx context.Context) ([]Neighbour, error) {
+	rawNeighbours := []linuxNeighbour{}
+	err := client.runJSON(ctx, &rawNeighbours, "ip", "-j", "neigh", "show")
+	if err != nil {
+		return nil, err
+	}
+
+	neighbours := []Neighbour{}
+	for _, rawNeighbour := range rawNeighbours {
+		if rawNeighbour.LLAddr == "" {
+			// FAILED and INCOMPLETE entries have no hardware address
+			continue
+		}
+
+		neighbours = append(neighbours, Neighbour{
+			Address:         rawNeighbour.Dst,
+			HardwareAddress: strings.ToLower(rawNeighbour.LLAddr),
+		})
+	}
+
+	return neighbours, nil
+}
+
+// ListInterfaces reads the global addresses of every link
+func (client *linuxClient) ListInterfaces(ctx context.Context) ([]Interface, error) {
+	links := []linuxLink{}
+	err := client.runJSON(ctx, &links, "ip", "-j", "addr", "show")
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make([]Interface, 0, len(links))
+	for _, link := range links {
+		subnets := []string{}
+		for _, address := range link.AddrInfo {
+			if address.Scope != "global" {
+				continue
+			}
+
+			if subnet := networkOf(address.Local, strconv.Itoa(address.PrefixLen)); subnet != "" {
+				subnets = append(subnets, subnet)
+			}
+		}
+
+		interfaces = append(interfaces, Interface{
+			Name:    link.IfName,
+			Subnets: subnets,
+		})
+	}
+
+	return interfaces, nil
+}
+
+// conntrackNoneDeleted is how conntrack reports having nothing to delete,
+// which it treats as a failure
+const conntrackNoneDeleted = "0 flow entries have been deleted"
+
+// KillStates deletes the conntrack entries of source. Masqueraded
+// connections through wan are told apart by their reply address.
+func (client *linuxClient) KillStates(ctx context.Context, source, wan string) error {
+	filters := [][]string{{}}
+
+	if wan != "" {
+		links := []linuxLink{}
+		err := client.runJSON(ctx, &links, "ip", "-j", "addr", "show", "dev", wan)
+		if err != nil {
+			return err
+		}
+
+		filters = [][]string{}
+		for _, link := range links {
+			for _, address := range link.AddrInfo {
+				if address.Scope == "global" {
+					filters = append(filters, []string{"--reply-dst", address.Local})
+				}
+			}
+		}
+	}
+
+	for _, filter := range filters {
+		args := append([]string{"-D", "-s", source}, filter...)
+		if _, err := client.run(ctx, "conntrack", args...); err != nil && !strings.Contains(err.Error(), conntrackNoneDeleted) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewLinuxClient returns a new remote.Client that drives Linux
+// policy routing through the given executor
+func NewLinuxClient(executor Executor, config LinuxConfig) Client {
+	return &linuxClient{
+		executor:     executor,
+		config:       config,
+		descriptions: map[int]linuxStoredRule{},
+	}
+}
@@ -0,0 +1,41 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Executor runs commands for the Linux client.
+// Tests can swap it out to inspect generated commands without root.
+type Executor interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// ExecutorFunc adapts a function to the Executor interface
+type ExecutorFunc func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+// Run calls f(ctx, name, args...)
+func (f ExecutorFunc) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return f(ctx, name, args...)
+}
+
+// LocalExecutor runs commands on this machine
+type LocalExecutor struct{}
+
+// Run executes the command and returns its stdout
+func (LocalExecutor) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	stderr := bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v %v: %v: %v", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return output, nil
+}
@@ -0,0 +1,49 @@
+package remote
+
+import "context"
+
+type linuxFirewallRule struct {
+	id          string // ip rule priority or nftables handle
+	iface       string
+	source      string
+	destination string
+	protocol    string
+	port        string
+	gateway     string
+	description string
+	family      string
+
+	client *linuxClient
+}
+
+func (rule *linuxFirewallRule) Source() string {
+	return rule.source
+}
+
+func (rule *linuxFirewallRule) Destination() string {
+	return rule.destination
+}
+
+func (rule *linuxFirewallRule) Protocol() string {
+	return rule.protocol
+}
+
+func (rule *linuxFirewallRule) Port() string {
+	return rule.port
+}
+
+func (rule *linuxFirewallRule) Gateway() string {
+	return rule.gateway
+}
+
+func (rule *linuxFirewallRule) Description() string {
+	return rule.description
+}
+
+func (rule *linuxFirewallRule) Family() string {
+	return rule.family
+}
+
+func (rule *linuxFirewallRule) Delete(ctx context.Context) error {
+	return rule.client.deleteRule(ctx, rule.family, rule.id)
+}
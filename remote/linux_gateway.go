@@ -0,0 +1,48 @@
+package remote
+
+import "time"
+
+type linuxGateway struct {
+	name    string
+	table   string
+	gateway string
+	dev     string
+	state   string // neighbour state, like REACHABLE
+	status  GatewayStatus
+}
+
+func (gateway *linuxGateway) Name() string {
+	return gateway.name
+}
+
+func (gateway *linuxGateway) Description() string {
+	return "table " + gateway.table + " via " + gateway.dev + " (" + gateway.state + ")"
+}
+
+func (gateway *linuxGateway) GatewayAddress() string {
+	return gateway.gateway
+}
+
+// MonitorAddress is the next hop itself: the neighbour table is
+// the only thing watching it
+func (gateway *linuxGateway) MonitorAddress() string {
+	return gateway.gateway
+}
+
+// RoundtripTime is unknown: the neighbour table only tells us
+// whether the next hop answers, not how quickly
+func (gateway *linuxGateway) RoundtripTime() time.Duration {
+	return 0
+}
+
+func (gateway *linuxGateway) RoundtripTimeDeviation() time.Duration {
+	return 0
+}
+
+func (gateway *linuxGateway) PacketLoss() float64 {
+	return 0
+}
+
+func (gateway *linuxGateway) Status() GatewayStatus {
+	return gateway.status
+}
@@ -0,0 +1,337 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// linuxTestExecutor records the commands it is asked to run and answers
+// them with output, which may change its answers as commands come in
+type linuxTestExecutor struct {
+	commands [][]string
+	output   func(command string) string
+}
+
+func (executor *linuxTestExecutor) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	command := append([]string{name}, args...)
+	executor.commands = append(executor.commands, command)
+
+	if executor.output == nil {
+		return nil, nil
+	}
+
+	return []byte(executor.output(strings.Join(command, " "))), nil
+}
+
+// ran returns the recorded commands starting with prefix
+func (executor *linuxTestExecutor) ran(prefix ...string) [][]string {
+	matching := [][]string{}
+	for _, command := range executor.commands {
+		if len(command) >= len(prefix) && reflect.DeepEqual(command[:len(prefix)], prefix) {
+			matching = append(matching, command)
+		}
+	}
+
+	return matching
+}
+
+const linuxTestNftRule = `{"nftables": [{"metainfo": {}}, {"rule": {
+	"family": "inet", "table": "creamy_gateway", "chain": "prerouting", "handle": 5,
+	"comment": "[creamy-gateway] say hi",
+	"expr": [
+		{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "lan"}},
+		{"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": "10.0.0.2"}},
+		{"mangle": {"key": {"meta": {"key": "mark"}}, "value": 100}}
+	]
+}}]}`
+
+func TestLinuxAddress(t *testing.T) {
+	for _, test := range []struct {
+		address  string
+		length   int
+		expected string
+	}{
+		{"10.0.0.2", 32, "10.0.0.2"},
+		{"10.0.0.0", 24, "10.0.0.0/24"},
+		{"fd00::2", 128, "fd00::2"},
+		{"2001:db8::", 32, "2001:db8::/32"},
+		{"all", 0, "*"},
+	} {
+		if actual := linuxAddress(test.address, test.length); actual != test.expected {
+			t.Errorf("%v/%v: expected %v, got %v", test.address, test.length, test.expected, actual)
+		}
+	}
+}
+
+func TestLinuxNftAddRuleQuoting(t *testing.T) {
+	listed := 0
+	executor := &linuxTestExecutor{
+		output: func(command string) string {
+			if command != "nft -j list chain inet creamy_gateway prerouting" {
+				return ""
+			}
+
+			// empty before the rule is added, and the rule afterwards
+			listed++
+			if listed == 1 {
+				return `{"nftables": [{"metainfo": {}}]}`
+			}
+			return linuxTestNftRule
+		},
+	}
+
+	client := NewLinuxClient(executor, LinuxConfig{
+		Mode:   LinuxModeNftables,
+		Tables: map[string]string{"VPN": "100"},
+	})
+
+	rule, err := client.AddRule(context.Background(), "lan", FamilyIPv4, "10.0.0.2", "*", "*", "*", "VPN", `[creamy-gateway] say "hi"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule.Description() != "[creamy-gateway] say hi" || rule.Gateway() != "VPN" {
+		t.Errorf("unexpected rule %v %v", rule.Description(), rule.Gateway())
+	}
+
+	added := executor.ran("nft", "add")
+	expected := []string{
+		"nft", "add", "rule", "inet", "creamy_gateway", "prerouting",
+		"iifname", `"lan"`,
+		"ip", "saddr", "10.0.0.2",
+		"meta", "mark", "set", "100",
+		"comment", `"[creamy-gateway] say hi"`,
+	}
+	if len(added) != 1 || !reflect.DeepEqual(added[0], expected) {
+		t.Errorf("expected %q, got %q", expected, added)
+	}
+}
+
+func TestLinuxNftAddRuleInsertsBeforeSpecificRules(t *testing.T) {
+	executor := &linuxTestExecutor{
+		output: func(command string) string {
+			if command == "nft -j list chain inet creamy_gateway prerouting" {
+				return linuxTestNftRule
+			}
+			return ""
+		},
+	}
+
+	client := NewLinuxClient(executor, LinuxConfig{
+		Mode:   LinuxModeNftables,
+		Tables: map[string]string{"VPN": "100", "WAN": "200"},
+	})
+
+	// the subnet rule is not listed afterwards, only the command matters
+	client.AddRule(context.Background(), "lan", FamilyIPv4, "10.0.0.0/24", "*", "tcp/udp", "53", "WAN", "subnet")
+
+	inserted := executor.ran("nft", "insert")
+	expected := []string{
+		"nft", "insert", "rule", "inet", "creamy_gateway", "prerouting", "position", "5",
+		"iifname", `"lan"`,
+		"ip", "saddr", "10.0.0.0/24",
+		"meta", "l4proto", "{", "tcp, udp", "}", "th", "dport", "53",
+		"meta", "mark", "set", "200",
+		"comment", `"subnet"`,
+	}
+	if len(inserted) != 1 || !reflect.DeepEqual(inserted[0], expected) {
+		t.Errorf("expected %q, got %q", expected, inserted)
+	}
+}
+
+func TestLinuxIPRuleAddRule(t *testing.T) {
+	executor := &linuxTestExecutor{
+		output: func(command string) string {
+			if strings.HasSuffix(command, "-j rule show") {
+				return "[]"
+			}
+			return ""
+		},
+	}
+
+	client := NewLinuxClient(executor, LinuxConfig{
+		Mode:         LinuxModeIPRule,
+		Tables:       map[string]string{"VPN": "100"},
+		RulePriority: 10000,
+	})
+
+	rule, err := client.AddRule(context.Background(), "lan", FamilyIPv6, "2001:db8::2", "*", "tcp", "443", "VPN", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule.Source() != "2001:db8::2" || rule.Family() != FamilyIPv6 || rule.Description() != "host" {
+		t.Errorf("unexpected rule %v %v %v", rule.Source(), rule.Family(), rule.Description())
+	}
+
+	expected := [][]string{
+		{"ip", "-6", "rule", "add", "priority", "10000", "from", "2001:db8::2", "ipproto", "tcp", "dport", "443", "iif", "lan", "lookup", "100"},
+	}
+	if added := executor.ran("ip", "-6", "rule", "add"); !reflect.DeepEqual(added, expected) {
+		t.Errorf("expected %q, got %q", expected, added)
+	}
+
+	if flushed := executor.ran("ip", "-6", "route", "flush", "cache"); len(flushed) != 1 {
+		t.Errorf("expected the route cache to be flushed once, got %q", flushed)
+	}
+}
+
+// linuxTestIPRules answers "ip rule show" with rules, and records added
+// and deleted rules so they are listed afterwards
+func linuxTestIPRules(rules *[]linuxIPRule) *linuxTestExecutor {
+	executor := &linuxTestExecutor{}
+	executor.output = func(command string) string {
+		fields := strings.Fields(command)
+
+		switch {
+		case strings.HasSuffix(command, "-j rule show"):
+			family := FamilyIPv4
+			if fields[1] == "-6" {
+				family = FamilyIPv6
+			}
+
+			listed := []linuxIPRule{}
+			for _, rule := range *rules {
+				if rule.Family == family {
+					listed = append(listed, rule)
+				}
+			}
+
+			output, _ := json.Marshal(listed)
+			return string(output)
+		case len(fields) > 4 && fields[2] == "rule" && fields[3] == "add":
+			rule := linuxIPRule{Family: FamilyIPv4}
+			if fields[1] == "-6" {
+				rule.Family = FamilyIPv6
+			}
+			for i := 4; i+1 < len(fields); i += 2 {
+				switch fields[i] {
+				case "priority":
+					rule.Priority, _ = strconv.Atoi(fields[i+1])
+				case "from":
+					rule.Src = fields[i+1]
+				case "iif":
+					rule.IIf = fields[i+1]
+				case "lookup":
+					rule.Table = fields[i+1]
+				}
+			}
+			*rules = append(*rules, rule)
+		case len(fields) > 4 && fields[2] == "rule" && fields[3] == "del":
+			for i, rule := range *rules {
+				if strconv.Itoa(rule.Priority) == fields[5] {
+					*rules = append((*rules)[:i], (*rules)[i+1:]...)
+					break
+				}
+			}
+		}
+
+		return ""
+	}
+
+	return executor
+}
+
+func TestLinuxIPRuleDescriptionsSurviveRestart(t *testing.T) {
+	rules := []linuxIPRule{}
+	config := LinuxConfig{
+		Mode:                LinuxModeIPRule,
+		Tables:              map[string]string{"VPN": "100", "WAN": "200"},
+		RulePriority:        10000,
+		StateFile:           filepath.Join(t.TempDir(), "state", "rules.json"),
+		RestoredDescription: "restored",
+	}
+
+	client := NewLinuxClient(linuxTestIPRules(&rules), config)
+	for _, source := range []string{"10.0.0.2", "10.0.0.3"} {
+		if _, err := client.AddRule(context.Background(), "lan", FamilyIPv4, source, "*", "*", "*", "VPN", "for "+source); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed, err := client.ListRules(context.Background(), "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := listed[0].Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else takes the freed priority for a different rule
+	rules = append(rules, linuxIPRule{Family: FamilyIPv4, Priority: listed[0].(*linuxFirewallRule).priority(t), Src: "10.0.0.9", IIf: "lan", Table: "200"})
+
+	restarted := NewLinuxClient(linuxTestIPRules(&rules), config)
+	listed, err = restarted.ListRules(context.Background(), "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptions := map[string]string{}
+	for _, rule := range listed {
+		descriptions[rule.Source()] = rule.Description()
+	}
+
+	expected := map[string]string{"10.0.0.3": "for 10.0.0.3", "10.0.0.9": "restored"}
+	if !reflect.DeepEqual(descriptions, expected) {
+		t.Errorf("expected %v, got %v", expected, descriptions)
+	}
+}
+
+func (rule *linuxFirewallRule) priority(t *testing.T) int {
+	priority, err := strconv.Atoi(rule.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return priority
+}
+
+func TestLinuxIPRulePriorityBands(t *testing.T) {
+	rules := []linuxIPRule{}
+	client := NewLinuxClient(linuxTestIPRules(&rules), LinuxConfig{
+		Mode:         LinuxModeIPRule,
+		Tables:       map[string]string{"VPN": "100"},
+		RulePriority: 10000,
+	})
+
+	add := func(source string) (int, error) {
+		rule, err := client.AddRule(context.Background(), "lan", FamilyIPv4, source, "*", "*", "*", "VPN", source)
+		if err != nil {
+			return 0, err
+		}
+		return rule.(*linuxFirewallRule).priority(t), nil
+	}
+
+	// wide subnets first, narrower ones still go before them
+	wide, err := add("10.0.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	narrow, err := add("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wide < 10500 || narrow < 10500 || narrow >= wide {
+		t.Errorf("expected the /24 below the /16 in the upper half, got %d and %d", narrow, wide)
+	}
+
+	for i := 0; i < linuxRulePriorityRange/4; i++ {
+		priority, err := add(fmt.Sprintf("10.0.%d.%d", i/200, i%200+1))
+		if err != nil {
+			t.Fatalf("host %d: %v", i, err)
+		}
+		if priority < 10250 || priority >= 10500 {
+			t.Fatalf("host %d got priority %d outside its band", i, priority)
+		}
+	}
+
+	if _, err := add("10.0.9.9"); err == nil {
+		t.Error("expected a full host band to be reported")
+	}
+}
@@ -0,0 +1,663 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/imroc/req"
+)
+
+type opnsenseClient struct {
+	host     string
+	username string
+	password string
+
+	session   *req.Req
+	placement Placement
+}
+
+func (client *opnsenseClient) path(path string) (string, error) {
+	url, err := url.Parse(client.host)
+	if err != nil {
+		return "", err
+	}
+	url.Path = path
+	return url.String(), nil
+}
+
+func (client *opnsenseClient) loggedOut(document *goquery.Document) bool {
+	return document.Find("input#usernamefld").Length() > 0
+}
+
+// csrf finds the per-session CSRF token.
+// OPNsense names the hidden input after a random key, so the key
+// must be sent along with the token.
+func (client *opnsenseClient) csrf(document *goquery.Document) (string, string, error) {
+	input := document.Find("input[type=\"hidden\"][autocomplete=\"new-password\"]").First()
+
+	key, keyFound := input.Attr("name")
+	token, tokenFound := input.Attr("value")
+	if !keyFound || !tokenFound {
+		return "", "", errors.New("could not find CSRF input value")
+	}
+
+	return key, token, nil
+}
+
+func (client *opnsenseClient) csrfParams(document *goquery.Document) (req.Param, req.Header, error) {
+	key, token, err := client.csrf(document)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req.Param{key: token}, req.Header{"X-CSRFToken": token}, nil
+}
+
+func (client *opnsenseClient) loginIfRequired(ctx context.Context, document *goquery.Document) error {
+	if !client.loggedOut(document) {
+		return nil
+	}
+
+	csrfParam, csrfHeader, err := client.csrfParams(document)
+	if err != nil {
+		return err
+	}
+
+	result, err := client.session.Post(client.host, ctx, csrfHeader, csrfParam, req.Param{
+		"usernamefld": client.username,
+		"passwordfld": client.password,
+		"login":       "1",
+	})
+
+	if err != nil {
+		return err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return errors.New("unexpected nil response during login")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status code %d when logging in", resp.StatusCode)
+	}
+
+	document, err = goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if !client.loggedOut(document) {
+		return nil
+	}
+
+	return errors.New("login failed")
+}
+
+func (client *opnsenseClient) fetchOrLogin(ctx context.Context, fetch func() (*goquery.Document, error)) (*goquery.Document, error) {
+	document, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	if client.loggedOut(document) {
+		err = client.loginIfRequired(ctx, document)
+		if err != nil {
+			return nil, err
+		}
+		document, err = fetch()
+	}
+
+	return document, err
+}
+
+func (client *opnsenseClient) page(ctx context.Context, path string, params req.QueryParam, operation string) (*goquery.Document, error) {
+	return client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		fullPath, err := client.path(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := client.session.Get(fullPath, ctx, params)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, fmt.Errorf("unexpected nil response during %v", operation)
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d during %v", resp.StatusCode, operation)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
+}
+
+func (client *opnsenseClient) post(ctx context.Context, document *goquery.Document, path string, params req.QueryParam, operation string, forms ...interface{}) error {
+	csrfParam, csrfHeader, err := client.csrfParams(document)
+	if err != nil {
+		return err
+	}
+
+	fullPath, err := client.path(path)
+	if err != nil {
+		return err
+	}
+
+	args := append([]interface{}{ctx, params, csrfHeader, csrfParam}, forms...)
+
+	result, err := client.session.Post(fullPath, args...)
+	if err != nil {
+		return err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return fmt.Errorf("unexpected nil response during %v", operation)
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 302 {
+		return fmt.Errorf("unexpected status code %d during %v", resp.StatusCode, operation)
+	}
+
+	return nil
+}
+
+func (client *opnsenseClient) ListGateways(ctx context.Context) ([]Gateway, error) {
+	doc, err := client.page(ctx, "/status_gateways.php", nil, "ListGateways")
+	if err != nil {
+		return nil, err
+	}
+
+	gatewayRows := doc.Find("section.page-content-main table tbody tr")
+
+	gateways := []Gateway{}
+
+	gatewayRows.Each(func(i int, s *goquery.Selection) {
+		/*
+			1 Name
+			2 Gateway
+			3 Monitor
+			4 RTT
+			5 RTTd
+			6 Loss
+			7 Status
+			8 Description
+		*/
+		if s.Find("td").Length() < 8 {
+			return
+		}
+
+		gateways = append(gateways, &opnsenseGateway{
+			name:        strings.TrimSpace(s.Find("td:nth-child(1)").Text()),
+			gateway:     strings.TrimSpace(s.Find("td:nth-child(2)").Text()),
+			monitor:     strings.TrimSpace(s.Find("td:nth-child(3)").Text()),
+			rtt:         parseGatewayDuration(s.Find("td:nth-child(4)").Text()),
+			rttsd:       parseGatewayDuration(s.Find("td:nth-child(5)").Text()),
+			loss:        parseGatewayLoss(s.Find("td:nth-child(6)").Text()),
+			status:      parseGatewayStatus(s.Find("td:nth-child(7)").Text()),
+			description: strings.TrimSpace(s.Find("td:nth-child(8)").Text()),
+		})
+	})
+
+	return gateways, nil
+}
+
+func (client *opnsenseClient) firewallRules(ctx context.Context, iface string) (*goquery.Document, error) {
+	return client.page(ctx, "/firewall_rules.php", req.QueryParam{"if": iface}, "ListRules for iface "+iface)
+}
+
+func (client *opnsenseClient) ListRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	doc, err := client.firewallRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	// floating and automatic rules have no checkbox and cannot be changed here
+	ruleRows := doc.Find("table#rules tbody tr.rule").FilterFunction(func(i int, s *goquery.Selection) bool {
+		return s.Find("input[type=\"checkbox\"][name=\"rule[]\"]").Length() > 0
+	})
+
+	rules := make([]FirewallRule, ruleRows.Length())
+
+	ruleRows.Each(func(i int, s *goquery.Selection) {
+		/*
+				1 <!-- checkbox -->
+				2 <!-- status icons -->
+				3 Protocol
+				4 Source
+				5 Port
+				6 Destination
+				7 Port
+				8 Gateway
+				9 Schedule
+			 10 Description
+			 11 Actions
+		*/
+
+		id, _ := s.Find("input[type=\"checkbox\"][name=\"rule[]\"]").Attr("value")
+
+		rule := &opnsenseFirewallRule{
+			id:          id,
+			iface:       iface,
+			source:      strings.TrimSpace(s.Find("td:nth-child(4)").Text()),
+			destination: strings.TrimSpace(s.Find("td:nth-child(6)").Text()),
+			protocol:    ruleProtocol(s.Find("td:nth-child(3)").Text()),
+			port:        rulePort(s.Find("td:nth-child(7)").Text()),
+			gateway:     strings.TrimSpace(s.Find("td:nth-child(8)").Text()),
+			description: strings.TrimSpace(s.Find("td:nth-child(10)").Text()),
+			family:      protocolFamily(s.Find("td:nth-child(3)").Text()),
+
+			client: client,
+		}
+		rules[i] = rule
+	})
+
+	return rules, nil
+}
+
+// applyChangesFirewallRules reloads the filter if OPNsense reports
+// pending changes. Unlike Sensemilla, the apply button lives in the
+// rules form itself and posts act=apply.
+func (client *opnsenseClient) applyChangesFirewallRules(ctx context.Context, doc *goquery.Document, iface string) error {
+	if deferApply(ctx, client, iface) {
+		return nil
+	}
+
+	if doc.Find("form#iform button[name=\"act\"][value=\"apply\"]").Length() <= 0 {
+		return errors.New("unable to find Apply Changes button")
+	}
+
+	return client.post(ctx, doc, "/firewall_rules.php", req.QueryParam{"if": iface}, "apply changes for iface "+iface, req.Param{
+		"act": "apply",
+		"if":  iface,
+	})
+}
+
+// Batch applies the filter once for every interface fn changed
+func (client *opnsenseClient) Batch(ctx context.Context, fn func(ctx context.Context) error) error {
+	return runBatch(ctx, client, fn, func(ctx context.Context, ifaces []string) error {
+		for _, iface := range ifaces {
+			doc, err := client.firewallRules(ctx, iface)
+			if err != nil {
+				return err
+			}
+
+			if err := client.applyChangesFirewallRules(ctx, doc, iface); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func opnsenseAddressParams(prefix, address string) req.Param {
+	if address == "*" {
+		return req.Param{
+			prefix: "any",
+		}
+	}
+
+	address, mask := splitNetwork(address)
+	switch {
+	case mask != "":
+	case AddressFamily(address) == FamilyIPv4:
+		mask = "32"
+	case AddressFamily(address) == FamilyIPv6:
+		mask = "128"
+	default:
+		// aliases carry their own addresses
+		return req.Param{
+			prefix: address,
+		}
+	}
+
+	return req.Param{
+		prefix:          address,
+		prefix + "mask": mask,
+	}
+}
+
+// opnsenseProtocol spells protocols the way the rule form lists them
+func opnsenseProtocol(protocol string) string {
+	if protocol == "*" {
+		return "any"
+	}
+
+	return strings.ToUpper(protocol)
+}
+
+func opnsensePortParams(port string) req.Param {
+	if port == "*" {
+		return req.Param{
+			"dstbeginport": "any",
+			"dstendport":   "any",
+		}
+	}
+
+	ports := strings.SplitN(port, "-", 2)
+	return req.Param{
+		"dstbeginport": ports[0],
+		"dstendport":   ports[len(ports)-1],
+	}
+}
+
+func (client *opnsenseClient) AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (FirewallRule, error) {
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	afterIndex, err := client.placement.insertAfter(rules, RulePrecedence(source, destination, protocol, port))
+	if err != nil {
+		return nil, err
+	}
+
+	// -1 asks for the top of the table
+	afterID := "-1"
+	if afterIndex >= 0 {
+		afterID = rules[afterIndex].(*opnsenseFirewallRule).id
+	}
+
+	doc, err := client.page(ctx, "/firewall_rules_edit.php", req.QueryParam{"if": iface}, "AddRule for iface "+iface)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.post(ctx, doc, "/firewall_rules_edit.php", req.QueryParam{"if": iface}, "AddRule for iface "+iface,
+		opnsenseAddressParams("src", source),
+		opnsenseAddressParams("dst", destination),
+		opnsensePortParams(port),
+		req.Param{
+			"interface": iface,
+			"descr":     description,
+			"gateway":   gateway,
+			"after":     afterID,
+
+			"type":       "pass",
+			"direction":  "in",
+			"ipprotocol": family,
+			"protocol":   opnsenseProtocol(protocol),
+			"statetype":  "keep state",
+			"quick":      "yes",
+			"Submit":     "Save",
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = client.firewallRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.applyChangesFirewallRules(ctx, doc, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err = client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if rule.Source() == source && rule.Gateway() == gateway && rule.Destination() == destination && rule.Protocol() == protocol && rule.Port() == port && rule.Description() == description && rule.Family() == family {
+			if err := client.placement.check(rules, i); err != nil {
+				if deleteErr := rule.Delete(ctx); deleteErr != nil {
+					return nil, fmt.Errorf("%v, and removing it failed: %v", err, deleteErr)
+				}
+				return nil, fmt.Errorf("%v, removed it", err)
+			}
+
+			return rule, nil
+		}
+	}
+
+	return nil, errors.New("unable to find created rule")
+}
+
+func (client *opnsenseClient) deleteRule(ctx context.Context, iface string, id string) error {
+	doc, err := client.firewallRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	err = client.post(ctx, doc, "/firewall_rules.php", req.QueryParam{"if": iface}, "deleting rule "+id+" for iface "+iface, req.Param{
+		"act": "del",
+		"if":  iface,
+		"id":  id,
+	})
+	if err != nil {
+		return err
+	}
+
+	doc, err = client.firewallRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	return client.applyChangesFirewallRules(ctx, doc, iface)
+}
+
+func (client *opnsenseClient) updateRule(ctx context.Context, iface, id, gateway, description string) (FirewallRule, error) {
+	query := req.QueryParam{"if": iface, "id": id}
+
+	doc, err := client.page(ctx, "/firewall_rules_edit.php", query, "updating rule "+id+" for iface "+iface)
+	if err != nil {
+		return nil, err
+	}
+
+	form := doc.Find("form#iform").First()
+	if form.Length() <= 0 {
+		return nil, errors.New("unable to find edit rule form")
+	}
+
+	// resubmit the form as-is so every other setting of the rule survives
+	values := formValues(form)
+	values.Set("gateway", gateway)
+	values.Set("descr", description)
+	values.Set("id", id)
+	values.Set("Submit", "Save")
+
+	err = client.post(ctx, doc, "/firewall_rules_edit.php", query, "updating rule "+id+" for iface "+iface, values)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = client.firewallRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.applyChangesFirewallRules(ctx, doc, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		opnRule, ok := rule.(*opnsenseFirewallRule)
+		if ok && opnRule.id == id && rule.Gateway() == gateway && rule.Description() == description {
+			return rule, nil
+		}
+	}
+
+	return nil, errors.New("unable to find updated rule")
+}
+
+// neighbourTable reads the ARP or NDP table from the diagnostics API,
+// after visiting its page to make sure the session is logged in
+func (client *opnsenseClient) neighbourTable(ctx context.Context, table, endpoint string) ([]Neighbour, error) {
+	_, err := client.page(ctx, "/ui/diagnostics/interface/"+table, nil, "ListNeighbours")
+	if err != nil {
+		return nil, err
+	}
+
+	apiPath, err := client.path("/api/diagnostics/interface/" + endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := client.session.Get(apiPath, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return nil, errors.New("unexpected nil response during ListNeighbours")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %d when fetching %v table", resp.StatusCode, table)
+	}
+
+	entries := []struct {
+		IP  string `json:"ip"`
+		MAC string `json:"mac"`
+	}{}
+	if err := result.ToJSON(&entries); err != nil {
+		return nil, err
+	}
+
+	neighbours := make([]Neighbour, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IP != "" && entry.MAC != "" {
+			neighbours = append(neighbours, Neighbour{
+				Address:         strings.SplitN(entry.IP, "%", 2)[0],
+				HardwareAddress: strings.ToLower(entry.MAC),
+			})
+		}
+	}
+
+	return neighbours, nil
+}
+
+func (client *opnsenseClient) ListNeighbours(ctx context.Context) ([]Neighbour, error) {
+	arp, err := client.neighbourTable(ctx, "arp", "getArp")
+	if err != nil {
+		return nil, err
+	}
+
+	ndp, err := client.neighbourTable(ctx, "ndp", "getNdp")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(arp, ndp...), nil
+}
+
+// IsMaster reads the virtual IP status from the diagnostics API:
+// the node is master if any of its CARP virtual IPs is
+func (client *opnsenseClient) IsMaster(ctx context.Context) (bool, error) {
+	_, err := client.page(ctx, "/ui/interfaces/vip_status", nil, "IsMaster")
+	if err != nil {
+		return false, err
+	}
+
+	apiPath, err := client.path("/api/diagnostics/interface/getVipStatus")
+	if err != nil {
+		return false, err
+	}
+
+	result, err := client.session.Get(apiPath, ctx)
+	if err != nil {
+		return false, err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return false, errors.New("unexpected nil response during IsMaster")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("unexpected status code %d when fetching CARP status", resp.StatusCode)
+	}
+
+	status := struct {
+		Rows []struct {
+			Mode   string `json:"mode"`
+			Status string `json:"status"`
+		} `json:"rows"`
+	}{}
+	if err := result.ToJSON(&status); err != nil {
+		return false, err
+	}
+
+	vips := 0
+	for _, row := range status.Rows {
+		if row.Mode != "" && row.Mode != "carp" {
+			continue
+		}
+
+		vips++
+		if strings.EqualFold(row.Status, "MASTER") {
+			return true, nil
+		}
+	}
+
+	if vips == 0 {
+		return false, errors.New("no CARP virtual IPs found")
+	}
+
+	return false, nil
+}
+
+// KillStates drops the states matching source through the
+// diagnostics API, which cannot filter by interface
+func (client *opnsenseClient) KillStates(ctx context.Context, source, wan string) error {
+	document, err := client.page(ctx, "/ui/diagnostics/firewall/states", nil, "KillStates")
+	if err != nil {
+		return err
+	}
+
+	return client.post(ctx, document, "/api/diagnostics/firewall/kill_states", nil, "KillStates", req.Param{
+		"filter": source,
+	})
+}
+
+func (client *opnsenseClient) SetPlacement(placement Placement) error {
+	if err := placement.Validate(); err != nil {
+		return err
+	}
+
+	client.placement = placement
+	return nil
+}
+
+// NewOPNsenseClient returns a new remote.Client compatible with
+// the OPNsense Web UI, with its own HTTP session
+func NewOPNsenseClient(host, username, password string, options SessionOptions) (Client, error) {
+	session, err := newSession(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &opnsenseClient{
+		host,
+		username,
+		password,
+
+		session,
+		DefaultPlacement,
+	}, nil
+}
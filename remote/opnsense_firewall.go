@@ -0,0 +1,53 @@
+package remote
+
+import "context"
+
+type opnsenseFirewallRule struct {
+	id          string
+	iface       string
+	source      string
+	destination string
+	protocol    string
+	port        string
+	gateway     string
+	description string
+	family      string
+
+	client *opnsenseClient
+}
+
+func (rule *opnsenseFirewallRule) Source() string {
+	return rule.source
+}
+
+func (rule *opnsenseFirewallRule) Destination() string {
+	return rule.destination
+}
+
+func (rule *opnsenseFirewallRule) Protocol() string {
+	return rule.protocol
+}
+
+func (rule *opnsenseFirewallRule) Port() string {
+	return rule.port
+}
+
+func (rule *opnsenseFirewallRule) Gateway() string {
+	return rule.gateway
+}
+
+func (rule *opnsenseFirewallRule) Description() string {
+	return rule.description
+}
+
+func (rule *opnsenseFirewallRule) Family() string {
+	return rule.family
+}
+
+func (rule *opnsenseFirewallRule) Delete(ctx context.Context) error {
+	return rule.client.deleteRule(ctx, rule.iface, rule.id)
+}
+
+func (rule *opnsenseFirewallRule) Update(ctx context.Context, gateway, description string) (FirewallRule, error) {
+	return rule.client.updateRule(ctx, rule.iface, rule.id, gateway, description)
+}
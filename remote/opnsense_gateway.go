@@ -0,0 +1,46 @@
+package remote
+
+import "time"
+
+type opnsenseGateway struct {
+	name        string
+	gateway     string
+	monitor     string
+	rtt         time.Duration
+	rttsd       time.Duration
+	loss        float64
+	status      GatewayStatus
+	description string
+}
+
+func (gateway *opnsenseGateway) Name() string {
+	return gateway.name
+}
+
+func (gateway *opnsenseGateway) Description() string {
+	return gateway.description
+}
+
+func (gateway *opnsenseGateway) GatewayAddress() string {
+	return gateway.gateway
+}
+
+func (gateway *opnsenseGateway) MonitorAddress() string {
+	return gateway.monitor
+}
+
+func (gateway *opnsenseGateway) RoundtripTime() time.Duration {
+	return gateway.rtt
+}
+
+func (gateway *opnsenseGateway) RoundtripTimeDeviation() time.Duration {
+	return gateway.rttsd
+}
+
+func (gateway *opnsenseGateway) PacketLoss() float64 {
+	return gateway.loss
+}
+
+func (gateway *opnsenseGateway) Status() GatewayStatus {
+	return gateway.status
+}
@@ -0,0 +1,174 @@
+package remote
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// PlacementAfterDefaultGateway inserts after the leading rules
+	// that use the default gateway, or at the bottom if there are none
+	PlacementAfterDefaultGateway = "after-default-gateway"
+	// PlacementTop inserts above every other rule
+	PlacementTop = "top"
+	// PlacementAfterAnchor inserts directly below the rule whose
+	// description contains the marker
+	PlacementAfterAnchor = "after-anchor"
+	// PlacementBeforeDefault inserts directly above the rule whose
+	// description contains the marker, usually a catch-all at the bottom
+	PlacementBeforeDefault = "before-default"
+)
+
+// Placement decides where AddRule puts new rules
+type Placement struct {
+	Strategy string
+	// Marker identifies the anchor or default rule by description
+	Marker string
+	// Prefix identifies the rules we manage by description. New rules
+	// are ordered among the managed rules next to them by RulePrecedence.
+	Prefix string
+}
+
+// DefaultPlacement is how rules have always been placed
+var DefaultPlacement = Placement{Strategy: PlacementAfterDefaultGateway}
+
+// PlacementClient can be told where to put new rules
+type PlacementClient interface {
+	Client
+
+	SetPlacement(placement Placement) error
+}
+
+// Validate checks the strategy is known and has a marker if it needs one
+func (placement Placement) Validate() error {
+	switch placement.Strategy {
+	case PlacementAfterDefaultGateway, PlacementTop:
+		return nil
+	case PlacementAfterAnchor, PlacementBeforeDefault:
+		if placement.Marker == "" {
+			return fmt.Errorf("placement %v needs a marker", placement.Strategy)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown placement %v", placement.Strategy)
+}
+
+// SourcePrecedence orders rule sources so more specific ones are
+// matched first: hosts, then subnets from narrow to wide, then aliases
+func SourcePrecedence(source string) int {
+	if source == "*" {
+		return 1001
+	}
+
+	if net.ParseIP(source) != nil {
+		return 0
+	}
+
+	if _, network, err := net.ParseCIDR(source); err == nil {
+		ones, bits := network.Mask.Size()
+		return bits - ones
+	}
+
+	// anything else names an alias, which could hold anything
+	return 1000
+}
+
+// RulePrecedence orders rules by SourcePrecedence, and rules for the
+// same kind of source so specific destinations go before the catch-all
+func RulePrecedence(source, destination, protocol, port string) int {
+	precedence := SourcePrecedence(source) * 2
+	if destination == "*" && protocol == "*" && port == "*" {
+		precedence++
+	}
+
+	return precedence
+}
+
+func rulePrecedence(rule FirewallRule) int {
+	return RulePrecedence(rule.Source(), rule.Destination(), rule.Protocol(), rule.Port())
+}
+
+func (placement Placement) managed(rule FirewallRule) bool {
+	return placement.Prefix != "" && strings.HasPrefix(rule.Description(), placement.Prefix)
+}
+
+func (placement Placement) marked(rule FirewallRule) bool {
+	return strings.Contains(rule.Description(), placement.Marker)
+}
+
+func (placement Placement) findMarked(rules []FirewallRule) (int, error) {
+	for i, rule := range rules {
+		if placement.marked(rule) {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("no rule with description marker %q for placement %v", placement.Marker, placement.Strategy)
+}
+
+// insertAfter returns the index of the rule a new rule with the given
+// RulePrecedence goes below, or -1 to put it at the top
+func (placement Placement) insertAfter(rules []FirewallRule, precedence int) (int, error) {
+	after, err := placement.strategyAfter(rules)
+	if err != nil {
+		return -1, err
+	}
+
+	// managed rules sit together where the strategy puts them,
+	// step over those that should be matched before or after this one
+	for after >= 0 && placement.managed(rules[after]) && rulePrecedence(rules[after]) > precedence {
+		after--
+	}
+	for after+1 < len(rules) && placement.managed(rules[after+1]) && rulePrecedence(rules[after+1]) <= precedence {
+		after++
+	}
+
+	return after, nil
+}
+
+func (placement Placement) strategyAfter(rules []FirewallRule) (int, error) {
+	switch placement.Strategy {
+	case PlacementTop:
+		return -1, nil
+	case PlacementAfterAnchor:
+		return placement.findMarked(rules)
+	case PlacementBeforeDefault:
+		index, err := placement.findMarked(rules)
+		return index - 1, err
+	case PlacementAfterDefaultGateway:
+		after := -1
+		for i, rule := range rules {
+			if rule.Gateway() != "*" {
+				break
+			}
+			after = i
+		}
+		if after < 0 {
+			return len(rules) - 1, nil
+		}
+		return after, nil
+	}
+
+	return -1, fmt.Errorf("unknown placement %v", placement.Strategy)
+}
+
+// check confirms the rule at index sits where it should, given the
+// rules as they are after the change was applied
+func (placement Placement) check(rules []FirewallRule, index int) error {
+	others := make([]FirewallRule, 0, len(rules)-1)
+	others = append(others, rules[:index]...)
+	others = append(others, rules[index+1:]...)
+
+	after, err := placement.insertAfter(others, rulePrecedence(rules[index]))
+	if err != nil {
+		return err
+	}
+
+	if after+1 != index {
+		return fmt.Errorf("created rule ended up at position %v instead of %v, which does not match placement %v", index, after+1, placement.Strategy)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ClientPool keeps clients with a login session of their own, so
+// reads need not wait for each other or for writes on another client.
+// Clients are made when needed, up to size, and dropped once idle for
+// longer than idleTimeout, before the remote expires their session.
+type ClientPool struct {
+	newClient   func() (Client, error)
+	idleTimeout time.Duration
+
+	// slots holds a token for every client handed out
+	slots chan struct{}
+
+	lock sync.Mutex
+	// idle clients, least recently used first
+	idle []pooledClient
+}
+
+type pooledClient struct {
+	client Client
+	since  time.Time
+}
+
+// NewClientPool creates a pool of up to size clients made by newClient.
+// An idleTimeout of 0 keeps idle clients forever.
+func NewClientPool(size int, idleTimeout time.Duration, newClient func() (Client, error)) *ClientPool {
+	return &ClientPool{
+		newClient:   newClient,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, size),
+	}
+}
+
+// Acquire waits for a client to be free, making one if none is idle.
+// The caller must Release it when finished.
+func (pool *ClientPool) Acquire(ctx context.Context) (Client, error) {
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	pool.lock.Lock()
+	for len(pool.idle) > 0 && pool.idleTimeout > 0 && time.Since(pool.idle[0].since) > pool.idleTimeout {
+		pool.idle = pool.idle[1:]
+	}
+
+	if count := len(pool.idle); count > 0 {
+		client := pool.idle[count-1].client
+		pool.idle = pool.idle[:count-1]
+		pool.lock.Unlock()
+
+		return client, nil
+	}
+	pool.lock.Unlock()
+
+	client, err := pool.newClient()
+	if err != nil {
+		<-pool.slots
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Release hands client back to the pool
+func (pool *ClientPool) Release(client Client) {
+	pool.lock.Lock()
+	pool.idle = append(pool.idle, pooledClient{client, time.Now()})
+	pool.lock.Unlock()
+
+	<-pool.slots
+}
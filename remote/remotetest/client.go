@@ -0,0 +1,303 @@
+// Package remotetest provides an in-memory remote.Client standing in
+// for a firewall, to exercise and measure callers without one.
+package remotetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// Client is an in-memory remote.Client. Each call takes RequestLatency,
+// and applying the filter takes ApplyLatency on top, like the filter
+// reload every change of a real firewall waits for.
+type Client struct {
+	RequestLatency time.Duration
+	ApplyLatency   time.Duration
+
+	// FailApplies is how many of the next applies fail
+	FailApplies int
+
+	lock     sync.Mutex
+	gateways []string
+	rules    []*rule
+	nextID   int
+	applies  int
+}
+
+// NewClient creates a Client whose gateways are all online
+func NewClient(gateways []string, requestLatency, applyLatency time.Duration) *Client {
+	return &Client{
+		RequestLatency: requestLatency,
+		ApplyLatency:   applyLatency,
+		gateways:       gateways,
+	}
+}
+
+// Applies counts how often the filter was applied
+func (client *Client) Applies() int {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.applies
+}
+
+func (client *Client) wait(ctx context.Context, latency time.Duration) error {
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// batchKey marks a context as part of a batch of client
+type batchKey struct {
+	client *Client
+}
+
+// batch collects the interfaces whose filter a batch held back
+type batch struct {
+	lock   sync.Mutex
+	ifaces map[string]bool
+}
+
+func (client *Client) apply(ctx context.Context, iface string) error {
+	if pending, ok := ctx.Value(batchKey{client}).(*batch); ok {
+		pending.lock.Lock()
+		pending.ifaces[iface] = true
+		pending.lock.Unlock()
+		return nil
+	}
+
+	if err := client.wait(ctx, client.ApplyLatency); err != nil {
+		return err
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.FailApplies > 0 {
+		client.FailApplies--
+		return errors.New("applying the filter failed")
+	}
+	client.applies++
+
+	return nil
+}
+
+// Batch applies the filter once for every interface fn changed
+func (client *Client) Batch(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(batchKey{client}).(*batch); ok {
+		return fn(ctx)
+	}
+
+	pending := &batch{ifaces: map[string]bool{}}
+	err := fn(context.WithValue(ctx, batchKey{client}, pending))
+
+	for iface := range pending.ifaces {
+		if applyErr := client.apply(ctx, iface); err == nil {
+			err = applyErr
+		}
+	}
+
+	return err
+}
+
+func (client *Client) ListGateways(ctx context.Context) ([]remote.Gateway, error) {
+	if err := client.wait(ctx, client.RequestLatency); err != nil {
+		return nil, err
+	}
+
+	gateways := make([]remote.Gateway, len(client.gateways))
+	for i, name := range client.gateways {
+		gateways[i] = &gateway{name}
+	}
+
+	return gateways, nil
+}
+
+func (client *Client) ListRules(ctx context.Context, iface string) ([]remote.FirewallRule, error) {
+	if err := client.wait(ctx, client.RequestLatency); err != nil {
+		return nil, err
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	rules := []remote.FirewallRule{}
+	for _, rule := range client.rules {
+		if rule.iface == iface {
+			copied := *rule
+			rules = append(rules, &copied)
+		}
+	}
+
+	return rules, nil
+}
+
+func (client *Client) AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (remote.FirewallRule, error) {
+	if err := client.wait(ctx, client.RequestLatency); err != nil {
+		return nil, err
+	}
+
+	client.lock.Lock()
+	client.nextID++
+	added := &rule{
+		id:          client.nextID,
+		iface:       iface,
+		family:      family,
+		source:      source,
+		destination: destination,
+		protocol:    protocol,
+		port:        port,
+		gateway:     gateway,
+		description: description,
+		client:      client,
+	}
+	client.rules = append([]*rule{added}, client.rules...)
+	client.lock.Unlock()
+
+	copied := *added
+	return &copied, client.apply(ctx, iface)
+}
+
+func (client *Client) updateRule(ctx context.Context, id int, gateway, description string) (remote.FirewallRule, error) {
+	if err := client.wait(ctx, client.RequestLatency); err != nil {
+		return nil, err
+	}
+
+	client.lock.Lock()
+	var updated *rule
+	for _, rule := range client.rules {
+		if rule.id == id {
+			rule.gateway = gateway
+			rule.description = description
+			copied := *rule
+			updated = &copied
+		}
+	}
+	client.lock.Unlock()
+
+	if updated == nil {
+		return nil, errors.New("rule no longer exists")
+	}
+
+	return updated, client.apply(ctx, updated.iface)
+}
+
+func (client *Client) deleteRule(ctx context.Context, id int) error {
+	if err := client.wait(ctx, client.RequestLatency); err != nil {
+		return err
+	}
+
+	client.lock.Lock()
+	iface := ""
+	for i, rule := range client.rules {
+		if rule.id == id {
+			iface = rule.iface
+			client.rules = append(client.rules[:i], client.rules[i+1:]...)
+			break
+		}
+	}
+	client.lock.Unlock()
+
+	if iface == "" {
+		return errors.New("rule no longer exists")
+	}
+
+	return client.apply(ctx, iface)
+}
+
+type rule struct {
+	id          int
+	iface       string
+	family      string
+	source      string
+	destination string
+	protocol    string
+	port        string
+	gateway     string
+	description string
+
+	client *Client
+}
+
+func (rule *rule) Source() string {
+	return rule.source
+}
+
+func (rule *rule) Destination() string {
+	return rule.destination
+}
+
+func (rule *rule) Protocol() string {
+	return rule.protocol
+}
+
+func (rule *rule) Port() string {
+	return rule.port
+}
+
+func (rule *rule) Gateway() string {
+	return rule.gateway
+}
+
+func (rule *rule) Description() string {
+	return rule.description
+}
+
+func (rule *rule) Family() string {
+	return rule.family
+}
+
+func (rule *rule) Delete(ctx context.Context) error {
+	return rule.client.deleteRule(ctx, rule.id)
+}
+
+func (rule *rule) Update(ctx context.Context, gateway, description string) (remote.FirewallRule, error) {
+	return rule.client.updateRule(ctx, rule.id, gateway, description)
+}
+
+// gateway is always online
+type gateway struct {
+	name string
+}
+
+func (gateway *gateway) Name() string {
+	return gateway.name
+}
+
+func (gateway *gateway) Description() string {
+	return gateway.name
+}
+
+func (gateway *gateway) GatewayAddress() string {
+	return ""
+}
+
+func (gateway *gateway) MonitorAddress() string {
+	return ""
+}
+
+func (gateway *gateway) RoundtripTime() time.Duration {
+	return 0
+}
+
+func (gateway *gateway) RoundtripTimeDeviation() time.Duration {
+	return 0
+}
+
+func (gateway *gateway) PacketLoss() float64 {
+	return 0
+}
+
+func (gateway *gateway) Status() remote.GatewayStatus {
+	return remote.GatewayOnline
+}
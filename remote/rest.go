@@ -0,0 +1,575 @@
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/imroc/req"
+)
+
+type restClient struct {
+	host     string
+	username string
+	password string
+
+	session   *req.Req
+	placement Placement
+}
+
+// restEnvelope wraps every response from the pfSense-API style endpoints
+type restEnvelope struct {
+	Status  string          `json:"status"`
+	Code    int             `json:"code"`
+	Return  int             `json:"return"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// restAddress is the source or destination of a firewall rule,
+// only one of the fields is expected to be set
+type restAddress struct {
+	Any     *string `json:"any,omitempty"`
+	Address string  `json:"address,omitempty"`
+	Network string  `json:"network,omitempty"`
+	Port    string  `json:"port,omitempty"`
+}
+
+func (address restAddress) String() string {
+	if address.Address != "" {
+		return address.Address
+	}
+
+	if address.Network != "" {
+		return address.Network
+	}
+
+	return "*"
+}
+
+type restRule struct {
+	Tracker     json.Number `json:"tracker"`
+	Type        string      `json:"type"`
+	Interface   string      `json:"interface"`
+	IPProtocol  string      `json:"ipprotocol"`
+	Protocol    string      `json:"protocol"`
+	Source      restAddress `json:"source"`
+	Destination restAddress `json:"destination"`
+	Gateway     string      `json:"gateway,omitempty"`
+	Description string      `json:"descr"`
+}
+
+type restGatewayStatus struct {
+	Name      string `json:"name"`
+	SourceIP  string `json:"srcip"`
+	MonitorIP string `json:"monitorip"`
+	Delay     string `json:"delay"`
+	StdDev    string `json:"stddev"`
+	Loss      string `json:"loss"`
+	Status    string `json:"status"`
+	Substatus string `json:"substatus"`
+}
+
+type restGatewayConfig struct {
+	Name        string `json:"name"`
+	Gateway     string `json:"gateway"`
+	Description string `json:"descr"`
+}
+
+type restAliasConfig struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Address     string `json:"address"`
+	Description string `json:"descr"`
+}
+
+type restSaveAlias struct {
+	ID          string   `json:"id,omitempty"`
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Address     []string `json:"address"`
+	Description string   `json:"descr"`
+	Apply       bool     `json:"apply"`
+}
+
+type restCreateRule struct {
+	Type        string `json:"type"`
+	Interface   string `json:"interface"`
+	IPProtocol  string `json:"ipprotocol"`
+	Protocol    string `json:"protocol"`
+	Source      string `json:"src"`
+	Destination string `json:"dst"`
+	Port        string `json:"dstport,omitempty"`
+	Gateway     string `json:"gateway"`
+	Description string `json:"descr"`
+	Top         bool   `json:"top"`
+	After       string `json:"after,omitempty"` // tracker of the rule to place the new rule below
+	Apply       bool   `json:"apply"`
+}
+
+type restUpdateRule struct {
+	Tracker     json.Number `json:"tracker"`
+	Gateway     string      `json:"gateway"`
+	Description string      `json:"descr"`
+	Apply       bool        `json:"apply"`
+}
+
+type restARPEntry struct {
+	IP  string `json:"ip"`
+	MAC string `json:"mac"`
+}
+
+type restInterface struct {
+	IPAddr   string `json:"ipaddr"`
+	Subnet   string `json:"subnet"`
+	IPAddrV6 string `json:"ipaddrv6"`
+	SubnetV6 string `json:"subnetv6"`
+}
+
+type restCARPStatus struct {
+	Enable bool `json:"enable"`
+	VIPs   []struct {
+		Status string `json:"status"`
+	} `json:"vips"`
+}
+
+type restKillStates struct {
+	Source string `json:"source"`
+}
+
+type restDeleteRule struct {
+	Tracker json.Number `json:"tracker"`
+	Apply   bool        `json:"apply"`
+}
+
+func (client *restClient) path(path string) (string, error) {
+	url, err := url.Parse(client.host)
+	if err != nil {
+		return "", err
+	}
+	url.Path = path
+	return url.String(), nil
+}
+
+func (client *restClient) authorization() string {
+	credentials := client.username + ":" + client.password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// do sends a JSON request to the API and decodes the "data" field
+// of the response envelope into data, if data is non-nil
+func (client *restClient) do(ctx context.Context, method, path string, body interface{}, data interface{}) error {
+	fullPath, err := client.path(path)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{
+		ctx,
+		req.Header{
+			"Accept":        "application/json",
+			"Authorization": client.authorization(),
+		},
+	}
+	if body != nil {
+		args = append(args, req.BodyJSON(body))
+	}
+
+	result, err := client.session.Do(method, fullPath, args...)
+	if err != nil {
+		return err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return fmt.Errorf("unexpected nil response during %v %v", method, path)
+	}
+
+	defer resp.Body.Close()
+
+	envelope := restEnvelope{}
+	if err := result.ToJSON(&envelope); err != nil {
+		return fmt.Errorf("unexpected status code %d during %v %v: %v", resp.StatusCode, method, path, err)
+	}
+
+	if resp.StatusCode != 200 || envelope.Return != 0 {
+		return fmt.Errorf("unexpected status code %d during %v %v: %v", resp.StatusCode, method, path, envelope.Message)
+	}
+
+	if data == nil || len(envelope.Data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(envelope.Data, data)
+}
+
+func (client *restClient) ListGateways(ctx context.Context) ([]Gateway, error) {
+	statuses := []restGatewayStatus{}
+	err := client.do(ctx, "GET", "/api/v1/status/gateway", nil, &statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := []restGatewayConfig{}
+	err = client.do(ctx, "GET", "/api/v1/routing/gateway", nil, &configs)
+	if err != nil {
+		return nil, err
+	}
+
+	configMap := make(map[string]restGatewayConfig, len(configs))
+	for _, config := range configs {
+		configMap[config.Name] = config
+	}
+
+	gateways := make([]Gateway, len(statuses))
+	for i, status := range statuses {
+		config := configMap[status.Name]
+
+		gateways[i] = &restGateway{
+			name:        status.Name,
+			gateway:     config.Gateway,
+			monitor:     status.MonitorIP,
+			rtt:         parseGatewayDuration(status.Delay),
+			rttsd:       parseGatewayDuration(status.StdDev),
+			loss:        parseGatewayLoss(status.Loss),
+			status:      parseGatewayStatus(status.Status),
+			description: config.Description,
+		}
+	}
+
+	return gateways, nil
+}
+
+func (client *restClient) ListRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	rawRules := []restRule{}
+	err := client.do(ctx, "GET", "/api/v1/firewall/rule", nil, &rawRules)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []FirewallRule{}
+	for _, rawRule := range rawRules {
+		if rawRule.Interface != iface {
+			continue
+		}
+
+		rules = append(rules, client.newRule(rawRule))
+	}
+
+	return rules, nil
+}
+
+func (client *restClient) newRule(rawRule restRule) *restFirewallRule {
+	gateway := rawRule.Gateway
+	if gateway == "" {
+		// match the web UI, which shows "*" for the default gateway
+		gateway = "*"
+	}
+
+	family := rawRule.IPProtocol
+	if family == "" {
+		family = FamilyIPv4
+	}
+
+	protocol := rawRule.Protocol
+	if protocol == "" || protocol == "any" {
+		protocol = "*"
+	}
+
+	return &restFirewallRule{
+		tracker:     rawRule.Tracker.String(),
+		iface:       rawRule.Interface,
+		source:      rawRule.Source.String(),
+		destination: rawRule.Destination.String(),
+		protocol:    protocol,
+		port:        rulePort(strings.Replace(rawRule.Destination.Port, ":", "-", 1)),
+		gateway:     gateway,
+		description: rawRule.Description,
+		family:      family,
+
+		client: client,
+	}
+}
+
+func restAddressParam(address string) string {
+	if address == "*" {
+		return "any"
+	}
+
+	return address
+}
+
+// AddRule creates a new rule where the placement puts it,
+// and removes it again if it ended up anywhere else
+func (client *restClient) AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (FirewallRule, error) {
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	afterIndex, err := client.placement.insertAfter(rules, RulePrecedence(source, destination, protocol, port))
+	if err != nil {
+		return nil, err
+	}
+
+	after := ""
+	if afterIndex >= 0 {
+		after = rules[afterIndex].(*restFirewallRule).tracker
+	}
+
+	rawRule := restRule{}
+
+	if protocol == "*" {
+		protocol = "any"
+	}
+	if port == "*" {
+		port = ""
+	}
+
+	err = client.do(ctx, "POST", "/api/v1/firewall/rule", restCreateRule{
+		Type:        "pass",
+		Interface:   iface,
+		IPProtocol:  family,
+		Protocol:    protocol,
+		Source:      restAddressParam(source),
+		Destination: restAddressParam(destination),
+		Port:        strings.Replace(port, "-", ":", 1),
+		Gateway:     gateway,
+		Description: description,
+		Top:         after == "",
+		After:       after,
+		Apply:       !deferApply(ctx, client, restApplyAll),
+	}, &rawRule)
+	if err != nil {
+		return nil, err
+	}
+
+	if rawRule.Tracker == "" {
+		return nil, errors.New("unable to find created rule")
+	}
+
+	rules, err = client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if rule.(*restFirewallRule).tracker == rawRule.Tracker.String() {
+			if err := client.placement.check(rules, i); err != nil {
+				if deleteErr := rule.Delete(ctx); deleteErr != nil {
+					return nil, fmt.Errorf("%v, and removing it failed: %v", err, deleteErr)
+				}
+				return nil, fmt.Errorf("%v, removed it", err)
+			}
+
+			return rule, nil
+		}
+	}
+
+	return nil, errors.New("unable to find created rule")
+}
+
+func (client *restClient) updateRule(ctx context.Context, tracker, gateway, description string) (FirewallRule, error) {
+	rawRule := restRule{}
+	err := client.do(ctx, "PUT", "/api/v1/firewall/rule", restUpdateRule{
+		Tracker:     json.Number(tracker),
+		Gateway:     gateway,
+		Description: description,
+		Apply:       !deferApply(ctx, client, restApplyAll),
+	}, &rawRule)
+	if err != nil {
+		return nil, err
+	}
+
+	if rawRule.Tracker == "" {
+		return nil, errors.New("unable to find updated rule")
+	}
+
+	return client.newRule(rawRule), nil
+}
+
+func (client *restClient) deleteRule(ctx context.Context, tracker string) error {
+	return client.do(ctx, "DELETE", "/api/v1/firewall/rule", restDeleteRule{
+		Tracker: json.Number(tracker),
+		Apply:   !deferApply(ctx, client, restApplyAll),
+	}, nil)
+}
+
+// restApplyAll is held back by rule changes in a batch,
+// the API applies every interface at once
+const restApplyAll = "*"
+
+// Batch applies the filter once after fn
+func (client *restClient) Batch(ctx context.Context, fn func(ctx context.Context) error) error {
+	return runBatch(ctx, client, fn, func(ctx context.Context, _ []string) error {
+		return client.do(ctx, "POST", "/api/v1/firewall/apply", nil, nil)
+	})
+}
+
+func (client *restClient) ListAliases(ctx context.Context) ([]Alias, error) {
+	configs := []restAliasConfig{}
+	err := client.do(ctx, "GET", "/api/v1/firewall/alias", nil, &configs)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make([]Alias, len(configs))
+	for i, config := range configs {
+		aliases[i] = &restAlias{
+			name:        config.Name,
+			description: config.Description,
+			addresses:   strings.Fields(config.Address),
+		}
+	}
+
+	return aliases, nil
+}
+
+func (client *restClient) UpdateAlias(ctx context.Context, name, description string, addresses []string) (Alias, error) {
+	aliases, err := client.ListAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	method := "POST"
+	alias := restSaveAlias{
+		Name:        name,
+		Type:        "host",
+		Address:     addresses,
+		Description: description,
+		Apply:       true,
+	}
+
+	for _, existing := range aliases {
+		if existing.Name() == name {
+			method = "PUT"
+			alias.ID = name
+			break
+		}
+	}
+
+	err = client.do(ctx, method, "/api/v1/firewall/alias", alias, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &restAlias{
+		name:        name,
+		description: description,
+		addresses:   addresses,
+	}, nil
+}
+
+// ListNeighbours reads the ARP table. The API has no NDP endpoint,
+// so IPv6 addresses are never found.
+func (client *restClient) ListNeighbours(ctx context.Context) ([]Neighbour, error) {
+	entries := []restARPEntry{}
+	err := client.do(ctx, "GET", "/api/v1/diagnostics/arp", nil, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	neighbours := make([]Neighbour, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IP != "" && entry.MAC != "" {
+			neighbours = append(neighbours, Neighbour{
+				Address:         entry.IP,
+				HardwareAddress: strings.ToLower(entry.MAC),
+			})
+		}
+	}
+
+	return neighbours, nil
+}
+
+// IsMaster reads the CARP status: the node is master
+// if any of its virtual IPs is
+func (client *restClient) IsMaster(ctx context.Context) (bool, error) {
+	status := restCARPStatus{}
+	err := client.do(ctx, "GET", "/api/v1/status/carp", nil, &status)
+	if err != nil {
+		return false, err
+	}
+
+	if !status.Enable || len(status.VIPs) == 0 {
+		return false, errors.New("no CARP virtual IPs found")
+	}
+
+	for _, vip := range status.VIPs {
+		if strings.EqualFold(vip.Status, "MASTER") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// KillStates deletes the states from source. The API cannot
+// filter by interface, so every state from source is dropped.
+func (client *restClient) KillStates(ctx context.Context, source, wan string) error {
+	return client.do(ctx, "DELETE", "/api/v1/firewall/states", restKillStates{source}, nil)
+}
+
+// ListInterfaces reads the interface config. Interfaces configured by
+// DHCP have no static address there and are listed without subnets.
+func (client *restClient) ListInterfaces(ctx context.Context) ([]Interface, error) {
+	rawInterfaces := map[string]restInterface{}
+	err := client.do(ctx, "GET", "/api/v1/interface", nil, &rawInterfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make([]Interface, 0, len(rawInterfaces))
+	for name, rawInterface := range rawInterfaces {
+		subnets := []string{}
+		if subnet := networkOf(rawInterface.IPAddr, rawInterface.Subnet); subnet != "" {
+			subnets = append(subnets, subnet)
+		}
+		if subnet := networkOf(rawInterface.IPAddrV6, rawInterface.SubnetV6); subnet != "" {
+			subnets = append(subnets, subnet)
+		}
+
+		interfaces = append(interfaces, Interface{
+			Name:    name,
+			Subnets: subnets,
+		})
+	}
+
+	sort.Slice(interfaces, func(i, j int) bool {
+		return interfaces[i].Name < interfaces[j].Name
+	})
+
+	return interfaces, nil
+}
+
+func (client *restClient) SetPlacement(placement Placement) error {
+	if err := placement.Validate(); err != nil {
+		return err
+	}
+
+	client.placement = placement
+	return nil
+}
+
+// NewRESTClient returns a new remote.Client compatible with
+// pfSense-API-ish JSON REST APIs, with its own HTTP session
+func NewRESTClient(host, username, password string, options SessionOptions) (Client, error) {
+	session, err := newSession(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &restClient{
+		host:     host,
+		username: username,
+		password: password,
+
+		session:   session,
+		placement: DefaultPlacement,
+	}, nil
+}
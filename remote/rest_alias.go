@@ -0,0 +1,19 @@
+package remote
+
+type restAlias struct {
+	name        string
+	description string
+	addresses   []string
+}
+
+func (alias *restAlias) Name() string {
+	return alias.name
+}
+
+func (alias *restAlias) Description() string {
+	return alias.description
+}
+
+func (alias *restAlias) Addresses() []string {
+	return alias.addresses
+}
@@ -0,0 +1,53 @@
+package remote
+
+import "context"
+
+type restFirewallRule struct {
+	tracker     string
+	iface       string
+	source      string
+	destination string
+	protocol    string
+	port        string
+	gateway     string
+	description string
+	family      string
+
+	client *restClient
+}
+
+func (rule *restFirewallRule) Source() string {
+	return rule.source
+}
+
+func (rule *restFirewallRule) Destination() string {
+	return rule.destination
+}
+
+func (rule *restFirewallRule) Protocol() string {
+	return rule.protocol
+}
+
+func (rule *restFirewallRule) Port() string {
+	return rule.port
+}
+
+func (rule *restFirewallRule) Gateway() string {
+	return rule.gateway
+}
+
+func (rule *restFirewallRule) Description() string {
+	return rule.description
+}
+
+func (rule *restFirewallRule) Family() string {
+	return rule.family
+}
+
+func (rule *restFirewallRule) Delete(ctx context.Context) error {
+	return rule.client.deleteRule(ctx, rule.tracker)
+}
+
+func (rule *restFirewallRule) Update(ctx context.Context, gateway, description string) (FirewallRule, error) {
+	return rule.client.updateRule(ctx, rule.tracker, gateway, description)
+}
@@ -0,0 +1,46 @@
+package remote
+
+import "time"
+
+type restGateway struct {
+	name        string
+	gateway     string
+	monitor     string
+	rtt         time.Duration
+	rttsd       time.Duration
+	loss        float64
+	status      GatewayStatus
+	description string
+}
+
+func (gateway *restGateway) Name() string {
+	return gateway.name
+}
+
+func (gateway *restGateway) Description() string {
+	return gateway.description
+}
+
+func (gateway *restGateway) GatewayAddress() string {
+	return gateway.gateway
+}
+
+func (gateway *restGateway) MonitorAddress() string {
+	return gateway.monitor
+}
+
+func (gateway *restGateway) RoundtripTime() time.Duration {
+	return gateway.rtt
+}
+
+func (gateway *restGateway) RoundtripTimeDeviation() time.Duration {
+	return gateway.rttsd
+}
+
+func (gateway *restGateway) PacketLoss() float64 {
+	return gateway.loss
+}
+
+func (gateway *restGateway) Status() GatewayStatus {
+	return gateway.status
+}
@@ -0,0 +1,233 @@
+package remote
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote/resttest"
+)
+
+func newRESTTestClient(t *testing.T) (*resttest.Server, Client) {
+	t.Helper()
+
+	server := resttest.NewServer("admin", "secret")
+	t.Cleanup(server.Close)
+
+	client, err := NewRESTClient(server.URL, "admin", "secret", SessionOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, client
+}
+
+func TestRESTListGateways(t *testing.T) {
+	server, client := newRESTTestClient(t)
+	server.AddGateway(resttest.Gateway{
+		Name:        "WAN_DHCP",
+		Address:     "192.0.2.1",
+		Monitor:     "192.0.2.1",
+		Delay:       "12.5ms",
+		StdDev:      "1.5ms",
+		Loss:        "2%",
+		Status:      "online",
+		Description: "Interface WAN_DHCP Gateway",
+	})
+	server.AddGateway(resttest.Gateway{
+		Name:   "VPN",
+		Status: "down",
+	})
+
+	gateways, err := client.ListGateways(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gateways) != 2 {
+		t.Fatalf("expected 2 gateways, got %d", len(gateways))
+	}
+
+	wan := gateways[0]
+	if wan.Name() != "WAN_DHCP" || wan.GatewayAddress() != "192.0.2.1" || wan.Description() != "Interface WAN_DHCP Gateway" {
+		t.Errorf("unexpected gateway %v %v %v", wan.Name(), wan.GatewayAddress(), wan.Description())
+	}
+	if wan.RoundtripTime() != 12500*time.Microsecond || wan.PacketLoss() != 2 || wan.Status() != GatewayOnline {
+		t.Errorf("unexpected status %v %v %v", wan.RoundtripTime(), wan.PacketLoss(), wan.Status())
+	}
+
+	if gateways[1].Status() != GatewayDown {
+		t.Errorf("expected VPN to be down, got %v", gateways[1].Status())
+	}
+}
+
+func TestRESTListRules(t *testing.T) {
+	server, client := newRESTTestClient(t)
+	server.AddRule(resttest.Rule{
+		Interface:   "lan",
+		Source:      "10.0.0.2",
+		Destination: "any",
+		Gateway:     "VPN",
+		Description: "host",
+	})
+	server.AddRule(resttest.Rule{
+		Interface:   "lan",
+		Family:      FamilyIPv6,
+		Source:      "any",
+		Destination: "2001:db8::1",
+		Protocol:    "tcp",
+		Port:        "1000:2000",
+	})
+	server.AddRule(resttest.Rule{
+		Interface: "opt1",
+		Source:    "10.1.0.2",
+	})
+
+	rules, err := client.ListRules(context.Background(), "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules on lan, got %d", len(rules))
+	}
+
+	host := rules[0]
+	if host.Source() != "10.0.0.2" || host.Destination() != "*" || host.Protocol() != "*" || host.Port() != "*" || host.Gateway() != "VPN" || host.Description() != "host" || host.Family() != FamilyIPv4 {
+		t.Errorf("unexpected host rule %v %v %v %v %v %v %v", host.Source(), host.Destination(), host.Protocol(), host.Port(), host.Gateway(), host.Description(), host.Family())
+	}
+
+	port := rules[1]
+	if port.Source() != "*" || port.Destination() != "2001:db8::1" || port.Protocol() != "tcp" || port.Port() != "1000-2000" || port.Gateway() != "*" || port.Family() != FamilyIPv6 {
+		t.Errorf("unexpected port rule %v %v %v %v %v %v", port.Source(), port.Destination(), port.Protocol(), port.Port(), port.Gateway(), port.Family())
+	}
+}
+
+func TestRESTAddRule(t *testing.T) {
+	server, client := newRESTTestClient(t)
+
+	rule, err := client.AddRule(context.Background(), "lan", FamilyIPv4, "10.0.0.2", "*", "tcp", "443", "VPN", "added")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule.Source() != "10.0.0.2" || rule.Protocol() != "tcp" || rule.Port() != "443" || rule.Gateway() != "VPN" || rule.Description() != "added" {
+		t.Errorf("unexpected rule %v %v %v %v %v", rule.Source(), rule.Protocol(), rule.Port(), rule.Gateway(), rule.Description())
+	}
+
+	stored := server.Rules()
+	if len(stored) != 1 || stored[0].Interface != "lan" || stored[0].Source != "10.0.0.2" || stored[0].Destination != "any" || stored[0].Port != "443" {
+		t.Errorf("unexpected stored rules %+v", stored)
+	}
+
+	if server.Applies() != 1 {
+		t.Errorf("expected the rule to be applied once, got %d", server.Applies())
+	}
+}
+
+func TestRESTAddRuleBatch(t *testing.T) {
+	server, client := newRESTTestClient(t)
+
+	err := client.(BatchClient).Batch(context.Background(), func(ctx context.Context) error {
+		for _, source := range []string{"10.0.0.2", "10.0.0.3"} {
+			if _, err := client.AddRule(ctx, "lan", FamilyIPv4, source, "*", "*", "*", "VPN", "added"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.Rules()) != 2 {
+		t.Errorf("expected 2 rules, got %d", len(server.Rules()))
+	}
+
+	if server.Applies() != 1 {
+		t.Errorf("expected the batch to be applied once, got %d", server.Applies())
+	}
+}
+
+func TestRESTDelete(t *testing.T) {
+	server, client := newRESTTestClient(t)
+	server.AddRule(resttest.Rule{Interface: "lan", Source: "10.0.0.2", Gateway: "VPN"})
+	kept := server.AddRule(resttest.Rule{Interface: "lan", Source: "10.0.0.3", Gateway: "VPN"})
+
+	rules, err := client.ListRules(context.Background(), "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rules[0].Delete(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := server.Rules()
+	if len(stored) != 1 || stored[0].Tracker != kept {
+		t.Errorf("expected only rule %d to be left, got %+v", kept, stored)
+	}
+
+	if err := rules[0].Delete(context.Background()); err == nil {
+		t.Error("expected deleting a missing rule to fail")
+	}
+}
+
+func TestRESTAddRulePlacement(t *testing.T) {
+	server, client := newRESTTestClient(t)
+	if err := client.(PlacementClient).SetPlacement(Placement{Strategy: PlacementAfterDefaultGateway, Prefix: "managed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	server.AddRule(resttest.Rule{Interface: "lan", Source: "any", Destination: "10.0.0.1", Description: "anti-lockout"})
+	server.AddRule(resttest.Rule{Interface: "opt1", Source: "10.1.0.2", Gateway: "VPN"})
+
+	add := func(source, destination string) {
+		t.Helper()
+		if _, err := client.AddRule(context.Background(), "lan", FamilyIPv4, source, destination, "*", "*", "VPN", "managed "+source+" "+destination); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("10.0.0.0/24", "*")
+	add("10.0.0.2", "*")
+	add("10.0.0.2", "192.0.2.1")
+	add("10.0.0.0/16", "*")
+
+	descriptions := []string{}
+	for _, rule := range server.Rules() {
+		if rule.Interface == "lan" {
+			descriptions = append(descriptions, rule.Description)
+		}
+	}
+
+	expected := []string{
+		"anti-lockout",
+		"managed 10.0.0.2 192.0.2.1",
+		"managed 10.0.0.2 *",
+		"managed 10.0.0.0/24 *",
+		"managed 10.0.0.0/16 *",
+	}
+	if !reflect.DeepEqual(descriptions, expected) {
+		t.Errorf("expected %q, got %q", expected, descriptions)
+	}
+}
+
+func TestRESTAddRuleBelowDestinationRules(t *testing.T) {
+	server, client := newRESTTestClient(t)
+	if err := client.(PlacementClient).SetPlacement(Placement{Strategy: PlacementTop, Prefix: "managed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, destination := range []string{"192.0.2.1", "*"} {
+		if _, err := client.AddRule(context.Background(), "lan", FamilyIPv4, "10.0.0.2", destination, "*", "*", "VPN", "managed "+destination); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules := server.Rules()
+	if len(rules) != 2 || rules[0].Destination != "192.0.2.1" || rules[1].Destination != "any" {
+		t.Errorf("expected the catch-all below the destination rule, got %+v", rules)
+	}
+}
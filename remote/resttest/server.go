@@ -0,0 +1,560 @@
+// Package resttest provides an in-memory stand-in for a pfSense-API
+// style firewall, so remote.NewRESTClient can be exercised without
+// a real firewall.
+package resttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Gateway known to the stand-in server
+type Gateway struct {
+	Name        string
+	Address     string
+	Monitor     string
+	Delay       string
+	StdDev      string
+	Loss        string
+	Status      string
+	Description string
+}
+
+// Rule stored by the stand-in server.
+// Source and Destination use "any" for any address.
+// Family defaults to "inet".
+type Rule struct {
+	Tracker     int
+	Interface   string
+	Family      string
+	Source      string
+	Destination string
+	// Protocol and Port default to any
+	Protocol    string
+	Port        string
+	Gateway     string
+	Description string
+}
+
+// Neighbour is an ARP entry of the stand-in server
+type Neighbour struct {
+	Address         string
+	HardwareAddress string
+}
+
+// Interface of the stand-in server, with its address like "10.0.0.1/24"
+type Interface struct {
+	Name     string
+	Address  string
+	Address6 string
+}
+
+// Alias stored by the stand-in server
+type Alias struct {
+	Name        string
+	Addresses   []string
+	Description string
+}
+
+// Server is a running stand-in firewall
+type Server struct {
+	*httptest.Server
+
+	username string
+	password string
+
+	lock        sync.Mutex
+	gateways    []Gateway
+	rules       []Rule
+	aliases     []Alias
+	neighbours  []Neighbour
+	interfaces  []Interface
+	carpStatus  string
+	killed      []string
+	applies     int
+	nextTracker int
+}
+
+type envelope struct {
+	Status  string      `json:"status"`
+	Code    int         `json:"code"`
+	Return  int         `json:"return"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data"`
+}
+
+func writeEnvelope(w http.ResponseWriter, code int, message string, data interface{}) {
+	status := "ok"
+	ret := 0
+	if code != 200 {
+		status = "bad request"
+		ret = 1
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(envelope{
+		Status:  status,
+		Code:    code,
+		Return:  ret,
+		Message: message,
+		Data:    data,
+	})
+}
+
+func address(value, port string) map[string]string {
+	encoded := map[string]string{"address": value}
+	if value == "any" || value == "" {
+		encoded = map[string]string{"any": ""}
+	}
+
+	if port != "" {
+		encoded["port"] = port
+	}
+
+	return encoded
+}
+
+func (rule Rule) encode() map[string]interface{} {
+	family := rule.Family
+	if family == "" {
+		family = "inet"
+	}
+
+	protocol := rule.Protocol
+	if protocol == "" {
+		protocol = "any"
+	}
+
+	return map[string]interface{}{
+		"tracker":     strconv.Itoa(rule.Tracker),
+		"type":        "pass",
+		"interface":   rule.Interface,
+		"ipprotocol":  family,
+		"protocol":    protocol,
+		"source":      address(rule.Source, ""),
+		"destination": address(rule.Destination, rule.Port),
+		"gateway":     rule.Gateway,
+		"descr":       rule.Description,
+	}
+}
+
+func (server *Server) handleGatewayStatus(w http.ResponseWriter, r *http.Request) {
+	data := make([]map[string]string, len(server.gateways))
+	for i, gateway := range server.gateways {
+		data[i] = map[string]string{
+			"name":      gateway.Name,
+			"srcip":     "",
+			"monitorip": gateway.Monitor,
+			"delay":     gateway.Delay,
+			"stddev":    gateway.StdDev,
+			"loss":      gateway.Loss,
+			"status":    gateway.Status,
+			"substatus": "none",
+		}
+	}
+
+	writeEnvelope(w, 200, "Success", data)
+}
+
+func (server *Server) handleGatewayConfig(w http.ResponseWriter, r *http.Request) {
+	data := make([]map[string]string, len(server.gateways))
+	for i, gateway := range server.gateways {
+		data[i] = map[string]string{
+			"name":    gateway.Name,
+			"gateway": gateway.Address,
+			"descr":   gateway.Description,
+		}
+	}
+
+	writeEnvelope(w, 200, "Success", data)
+}
+
+func (server *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		data := make([]map[string]interface{}, len(server.rules))
+		for i, rule := range server.rules {
+			data[i] = rule.encode()
+		}
+
+		writeEnvelope(w, 200, "Success", data)
+	case "POST":
+		body := struct {
+			Interface   string `json:"interface"`
+			Family      string `json:"ipprotocol"`
+			Source      string `json:"src"`
+			Destination string `json:"dst"`
+			Protocol    string `json:"protocol"`
+			Port        string `json:"dstport"`
+			Gateway     string `json:"gateway"`
+			Description string `json:"descr"`
+			Top         bool   `json:"top"`
+			After       string `json:"after"`
+			Apply       bool   `json:"apply"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeEnvelope(w, 400, err.Error(), nil)
+			return
+		}
+
+		// after places the rule below the rule with that tracker
+		position := len(server.rules)
+		if body.Top {
+			position = 0
+		} else if body.After != "" {
+			position = -1
+			for i, rule := range server.rules {
+				if strconv.Itoa(rule.Tracker) == body.After {
+					position = i + 1
+				}
+			}
+			if position < 0 {
+				writeEnvelope(w, 400, "Firewall rule to place after does not exist", nil)
+				return
+			}
+		}
+
+		server.nextTracker++
+		rule := Rule{
+			Tracker:     server.nextTracker,
+			Interface:   body.Interface,
+			Family:      body.Family,
+			Source:      body.Source,
+			Destination: body.Destination,
+			Protocol:    body.Protocol,
+			Port:        body.Port,
+			Gateway:     body.Gateway,
+			Description: body.Description,
+		}
+
+		server.rules = append(server.rules[:position], append([]Rule{rule}, server.rules[position:]...)...)
+		if body.Apply {
+			server.applies++
+		}
+
+		writeEnvelope(w, 200, "Success", rule.encode())
+	case "PUT":
+		body := struct {
+			Tracker     json.Number `json:"tracker"`
+			Gateway     *string     `json:"gateway"`
+			Description *string     `json:"descr"`
+			Apply       bool        `json:"apply"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeEnvelope(w, 400, err.Error(), nil)
+			return
+		}
+
+		tracker, err := body.Tracker.Int64()
+		if err != nil {
+			writeEnvelope(w, 400, err.Error(), nil)
+			return
+		}
+
+		for i, rule := range server.rules {
+			if int64(rule.Tracker) == tracker {
+				if body.Gateway != nil {
+					server.rules[i].Gateway = *body.Gateway
+				}
+				if body.Description != nil {
+					server.rules[i].Description = *body.Description
+				}
+				if body.Apply {
+					server.applies++
+				}
+				writeEnvelope(w, 200, "Success", server.rules[i].encode())
+				return
+			}
+		}
+
+		writeEnvelope(w, 404, "Firewall rule does not exist", nil)
+	case "DELETE":
+		body := struct {
+			Tracker json.Number `json:"tracker"`
+			Apply   bool        `json:"apply"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeEnvelope(w, 400, err.Error(), nil)
+			return
+		}
+
+		tracker, err := body.Tracker.Int64()
+		if err != nil {
+			writeEnvelope(w, 400, err.Error(), nil)
+			return
+		}
+
+		for i, rule := range server.rules {
+			if int64(rule.Tracker) == tracker {
+				server.rules = append(server.rules[:i], server.rules[i+1:]...)
+				if body.Apply {
+					server.applies++
+				}
+				writeEnvelope(w, 200, "Success", rule.encode())
+				return
+			}
+		}
+
+		writeEnvelope(w, 404, "Firewall rule does not exist", nil)
+	default:
+		writeEnvelope(w, 405, "Method not allowed", nil)
+	}
+}
+
+func (server *Server) handleApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeEnvelope(w, 405, "Method not allowed", nil)
+		return
+	}
+
+	server.applies++
+	writeEnvelope(w, 200, "Success", nil)
+}
+
+func (server *Server) handleARP(w http.ResponseWriter, r *http.Request) {
+	data := make([]map[string]string, len(server.neighbours))
+	for i, neighbour := range server.neighbours {
+		data[i] = map[string]string{
+			"ip":  neighbour.Address,
+			"mac": neighbour.HardwareAddress,
+		}
+	}
+
+	writeEnvelope(w, 200, "Success", data)
+}
+
+func (server *Server) handleInterfaces(w http.ResponseWriter, r *http.Request) {
+	split := func(address string) (string, string) {
+		parts := strings.SplitN(address, "/", 2)
+		if len(parts) != 2 {
+			return address, ""
+		}
+		return parts[0], parts[1]
+	}
+
+	data := make(map[string]map[string]string, len(server.interfaces))
+	for _, iface := range server.interfaces {
+		ipaddr, subnet := split(iface.Address)
+		ipaddrv6, subnetv6 := split(iface.Address6)
+		data[iface.Name] = map[string]string{
+			"ipaddr":   ipaddr,
+			"subnet":   subnet,
+			"ipaddrv6": ipaddrv6,
+			"subnetv6": subnetv6,
+		}
+	}
+
+	writeEnvelope(w, 200, "Success", data)
+}
+
+func (server *Server) handleCARP(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"enable": server.carpStatus != "",
+		"vips":   []map[string]string{},
+	}
+	if server.carpStatus != "" {
+		data["vips"] = []map[string]string{{"status": server.carpStatus}}
+	}
+
+	writeEnvelope(w, 200, "Success", data)
+}
+
+func (server *Server) handleStates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		writeEnvelope(w, 405, "Method not allowed", nil)
+		return
+	}
+
+	body := struct {
+		Source string `json:"source"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Source == "" {
+		writeEnvelope(w, 400, "Firewall state source required", nil)
+		return
+	}
+
+	server.killed = append(server.killed, body.Source)
+	writeEnvelope(w, 200, "Success", nil)
+}
+
+func (server *Server) handleAliases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		data := make([]map[string]string, len(server.aliases))
+		for i, alias := range server.aliases {
+			data[i] = map[string]string{
+				"name":    alias.Name,
+				"type":    "host",
+				"address": strings.Join(alias.Addresses, " "),
+				"descr":   alias.Description,
+			}
+		}
+
+		writeEnvelope(w, 200, "Success", data)
+	case "POST", "PUT":
+		body := struct {
+			ID          string   `json:"id"`
+			Name        string   `json:"name"`
+			Address     []string `json:"address"`
+			Description string   `json:"descr"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeEnvelope(w, 400, err.Error(), nil)
+			return
+		}
+
+		alias := Alias{
+			Name:        body.Name,
+			Addresses:   body.Address,
+			Description: body.Description,
+		}
+
+		if r.Method == "POST" {
+			server.aliases = append(server.aliases, alias)
+			writeEnvelope(w, 200, "Success", nil)
+			return
+		}
+
+		for i, existing := range server.aliases {
+			if existing.Name == body.ID {
+				server.aliases[i] = alias
+				writeEnvelope(w, 200, "Success", nil)
+				return
+			}
+		}
+
+		writeEnvelope(w, 404, "Alias does not exist", nil)
+	default:
+		writeEnvelope(w, 405, "Method not allowed", nil)
+	}
+}
+
+func (server *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != server.username || password != server.password {
+			writeEnvelope(w, 401, "Authentication failed", nil)
+			return
+		}
+
+		server.lock.Lock()
+		defer server.lock.Unlock()
+
+		handler(w, r)
+	}
+}
+
+// AddGateway makes a gateway visible to clients
+func (server *Server) AddGateway(gateway Gateway) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.gateways = append(server.gateways, gateway)
+}
+
+// AddNeighbour makes an ARP entry visible to clients
+func (server *Server) AddNeighbour(neighbour Neighbour) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.neighbours = append(server.neighbours, neighbour)
+}
+
+// AddInterface makes an interface visible to clients
+func (server *Server) AddInterface(iface Interface) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.interfaces = append(server.interfaces, iface)
+}
+
+// SetCARPStatus sets the status of the server's virtual IP,
+// like "MASTER" or "BACKUP". An empty status disables CARP.
+func (server *Server) SetCARPStatus(status string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.carpStatus = status
+}
+
+// KilledStates lists the sources whose states clients killed, in order
+func (server *Server) KilledStates() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return append([]string{}, server.killed...)
+}
+
+// Applies counts how often clients applied the filter, by applying
+// along with a rule change or on its own
+func (server *Server) Applies() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.applies
+}
+
+// AddRule stores a rule as if an administrator had created it,
+// placing it below existing rules. The assigned tracker is returned.
+func (server *Server) AddRule(rule Rule) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.nextTracker++
+	rule.Tracker = server.nextTracker
+	server.rules = append(server.rules, rule)
+
+	return rule.Tracker
+}
+
+// Rules returns a copy of the stored rules, in order
+func (server *Server) Rules() []Rule {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	rules := make([]Rule, len(server.rules))
+	copy(rules, server.rules)
+
+	return rules
+}
+
+// Aliases returns a copy of the stored aliases
+func (server *Server) Aliases() []Alias {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	aliases := make([]Alias, len(server.aliases))
+	copy(aliases, server.aliases)
+
+	return aliases
+}
+
+// NewServer starts a stand-in firewall accepting the given credentials.
+// The caller should call Close when finished.
+func NewServer(username, password string) *Server {
+	server := &Server{
+		username:    username,
+		password:    password,
+		nextTracker: 1600000000,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status/gateway", server.authorized(server.handleGatewayStatus))
+	mux.HandleFunc("/api/v1/routing/gateway", server.authorized(server.handleGatewayConfig))
+	mux.HandleFunc("/api/v1/firewall/rule", server.authorized(server.handleRules))
+	mux.HandleFunc("/api/v1/firewall/apply", server.authorized(server.handleApply))
+	mux.HandleFunc("/api/v1/firewall/alias", server.authorized(server.handleAliases))
+	mux.HandleFunc("/api/v1/diagnostics/arp", server.authorized(server.handleARP))
+	mux.HandleFunc("/api/v1/interface", server.authorized(server.handleInterfaces))
+	mux.HandleFunc("/api/v1/status/carp", server.authorized(server.handleCARP))
+	mux.HandleFunc("/api/v1/firewall/states", server.authorized(server.handleStates))
+
+	server.Server = httptest.NewServer(mux)
+
+	return server
+}
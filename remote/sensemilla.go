@@ -1,9 +1,12 @@
 package remote
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/PuerkitoBio/goquery"
@@ -14,6 +17,15 @@ type sensemillaClient struct {
 	host     string
 	username string
 	password string
+
+	session   *req.Req
+	placement Placement
+
+	// profiles are checked in order, overrides before the default
+	profiles []SensemillaProfile
+	// profile matches the firmware version detected at login
+	profile SensemillaProfile
+	version string
 }
 
 func (client *sensemillaClient) path(path string) (string, error) {
@@ -25,25 +37,51 @@ func (client *sensemillaClient) path(path string) (string, error) {
 	return url.String(), nil
 }
 
+// loginProfile returns the profile whose login form is on document.
+// The version is not known before login, so every profile is tried.
+func (client *sensemillaClient) loginProfile(document *goquery.Document) (SensemillaProfile, bool) {
+	for _, profile := range client.profiles {
+		profile = profile.withDefaults()
+		if document.Find(profile.LoginForm).Length() > 0 {
+			return profile, true
+		}
+	}
+
+	return SensemillaProfile{}, false
+}
+
 func (client *sensemillaClient) loggedOut(document *goquery.Document) bool {
-	return document.Find("form.login").Length() > 0
+	_, found := client.loginProfile(document)
+	return found
 }
 
-func (client *sensemillaClient) loginIfRequired(document *goquery.Document) error {
-	if !client.loggedOut(document) {
+// useVersion switches to the profile matching the firmware version
+func (client *sensemillaClient) useVersion(version string) {
+	if version == client.version {
+		return
+	}
+
+	client.version = version
+	client.profile = selectSensemillaProfile(client.profiles, version)
+	log.Println("detected remote firmware version", version)
+}
+
+func (client *sensemillaClient) loginIfRequired(ctx context.Context, document *goquery.Document) error {
+	profile, found := client.loginProfile(document)
+	if !found {
 		return nil
 	}
 
-	csrf, csrfFound := document.Find("input[name=\"__csrf_magic\"]").Attr("value")
+	csrf, csrfFound := document.Find(profile.csrfSelector()).Attr("value")
 	if !csrfFound {
 		return errors.New("could not find CSRF input value")
 	}
 
-	result, err := req.Post(client.host, req.Param{
-		"__csrf_magic": csrf,
-		"usernamefld":  client.username,
-		"passwordfld":  client.password,
-		"login":        "Sign In",
+	result, err := client.session.Post(client.host, ctx, req.Param{
+		profile.CSRFField:     csrf,
+		profile.UsernameField: client.username,
+		profile.PasswordField: client.password,
+		profile.LoginField:    profile.LoginValue,
 	})
 
 	if err != nil {
@@ -66,20 +104,26 @@ func (client *sensemillaClient) loginIfRequired(document *goquery.Document) erro
 	}
 
 	if !client.loggedOut(document) {
+		// we land on the dashboard, which shows the version
+		version := detectSensemillaVersion(document)
+		if version == "" {
+			log.Println("could not detect remote firmware version, keeping the current profile")
+		}
+		client.useVersion(version)
 		return nil
 	}
 
 	return errors.New("login failed")
 }
 
-func (client *sensemillaClient) fetchOrLogin(fetch func() (*goquery.Document, error)) (*goquery.Document, error) {
+func (client *sensemillaClient) fetchOrLogin(ctx context.Context, fetch func() (*goquery.Document, error)) (*goquery.Document, error) {
 	document, err := fetch()
 	if err != nil {
 		return nil, err
 	}
 
 	if client.loggedOut(document) {
-		err = client.loginIfRequired(document)
+		err = client.loginIfRequired(ctx, document)
 		if err != nil {
 			return nil, err
 		}
@@ -89,14 +133,14 @@ func (client *sensemillaClient) fetchOrLogin(fetch func() (*goquery.Document, er
 	return document, err
 }
 
-func (client *sensemillaClient) gateways() (*goquery.Document, error) {
-	return client.fetchOrLogin(func() (*goquery.Document, error) {
+func (client *sensemillaClient) gateways(ctx context.Context) (*goquery.Document, error) {
+	return client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
 		path, err := client.path("/status_gateways.php")
 		if err != nil {
 			return nil, err
 		}
 
-		result, err := req.Get(path)
+		result, err := client.session.Get(path, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -115,54 +159,55 @@ func (client *sensemillaClient) gateways() (*goquery.Document, error) {
 	})
 }
 
-func (client *sensemillaClient) ListGateways() ([]Gateway, error) {
-	doc, err := client.gateways()
+func (client *sensemillaClient) ListGateways(ctx context.Context) ([]Gateway, error) {
+	doc, err := client.gateways(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := newHTMLTable("gateways", doc.Find(client.profile.GatewayTable), client.profile.Columns, "Name", "Gateway", "Status")
 	if err != nil {
 		return nil, err
 	}
 
-	gatewayRows := doc.Find(".table-responsive .table tbody tr")
+	gateways := []Gateway{}
 
-	gateways := make([]Gateway, gatewayRows.Length())
+	table.each(func(s *goquery.Selection) error {
+		statusCell := table.cell(s, "Status")
 
-	gatewayRows.Each(func(i int, s *goquery.Selection) {
-		/*
-			1 Name
-			2 Gateway
-			3 Monitor
-			4 RTT
-			5 RTTsd
-			6 Loss
-			7 Status
-			8 Description
-		*/
 		gateway := &sensemillaGateway{
-			name:        strings.TrimSpace(s.Find("td:nth-child(1)").Text()),
-			gateway:     strings.TrimSpace(s.Find("td:nth-child(2)").Text()),
-			monitor:     strings.TrimSpace(s.Find("td:nth-child(3)").Text()),
-			rtt:         strings.TrimSpace(s.Find("td:nth-child(4)").Text()),
-			rttsd:       strings.TrimSpace(s.Find("td:nth-child(5)").Text()),
-			loss:        strings.TrimSpace(s.Find("td:nth-child(6)").Text()),
-			status:      strings.TrimSpace(s.Find("td:nth-child(7)").Text()),
-			description: strings.TrimSpace(s.Find("td:nth-child(8)").Text()),
+			name:        table.text(s, "Name"),
+			gateway:     table.text(s, "Gateway"),
+			monitor:     table.text(s, "Monitor"),
+			rtt:         parseGatewayDuration(table.text(s, "RTT")),
+			rttsd:       parseGatewayDuration(table.text(s, "RTTsd")),
+			loss:        parseGatewayLoss(table.text(s, "Loss")),
+			status:      parseGatewayStatus(statusCell.Text()),
+			description: table.text(s, "Description"),
 		}
 
-		gateway.online = s.Find("td:nth-child(7)").HasClass("bg-success")
+		// the cell colour is the most reliable signal when the text is unfamiliar
+		if statusCell.HasClass("bg-success") {
+			gateway.status = GatewayOnline
+		} else if statusCell.HasClass("bg-danger") {
+			gateway.status = GatewayDown
+		}
 
-		gateways[i] = gateway
+		gateways = append(gateways, gateway)
+		return nil
 	})
 
 	return gateways, nil
 }
 
-func (client *sensemillaClient) firewallRules(iface string) (*goquery.Document, error) {
-	return client.fetchOrLogin(func() (*goquery.Document, error) {
+func (client *sensemillaClient) firewallRules(ctx context.Context, iface string) (*goquery.Document, error) {
+	return client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
 		ifacePath, err := client.path("/firewall_rules.php")
 		if err != nil {
 			return nil, err
 		}
 
-		result, err := req.Get(ifacePath, req.QueryParam{"if": iface})
+		result, err := client.session.Get(ifacePath, ctx, req.QueryParam{"if": iface})
 		if err != nil {
 			return nil, err
 		}
@@ -181,76 +226,132 @@ func (client *sensemillaClient) firewallRules(iface string) (*goquery.Document,
 	})
 }
 
-func (client *sensemillaClient) ListRules(iface string) ([]FirewallRule, error) {
-	doc, err := client.firewallRules(iface)
+// parseRules reads the rule table of a firewall_rules.php page
+func (client *sensemillaClient) parseRules(doc *goquery.Document, iface string) ([]*sensemillaFirewallRule, error) {
+	table, err := newHTMLTable("rules", doc.Find(client.profile.RuleTable), client.profile.Columns, "Protocol", "Source", "Destination", "Gateway", "Description")
 	if err != nil {
 		return nil, err
 	}
 
-	ruleRows := doc.Find("#ruletable tbody tr")
-
-	rules := make([]FirewallRule, ruleRows.Length())
+	rules := []*sensemillaFirewallRule{}
 
-	ruleRows.Each(func(i int, s *goquery.Selection) {
-		/*
-				1 <!-- checkbox -->
-				2 <!-- status icons -->
-				3 States
-				4 Protocol
-				5 Source
-				6 Port
-				7 Destination
-				8 Port
-				9 Gateway
-			 10 Queue
-			 11	Schedule
-			 12	Description
-			 13	Actions
-		*/
+	err = table.each(func(s *goquery.Selection) error {
+		id, found := s.Find("input[type=\"checkbox\"]").Attr("value")
+		if !found {
+			// automatic rules such as the anti-lockout rule cannot be changed
+			return nil
+		}
 
-		id, _ := s.Find("input[type=\"checkbox\"]").Attr("value")
+		// the states link carries the tracker, which survives reordering
+		tracker := ""
+		if statesLink, found := s.Find("a[href*=\"ruleid=\"]").Attr("href"); found {
+			if statesURL, err := url.Parse(statesLink); err == nil {
+				tracker = statesURL.Query().Get("ruleid")
+			}
+		}
 
-		rule := &sensemillaFirewallRule{
+		rules = append(rules, &sensemillaFirewallRule{
 			id:          id,
+			tracker:     tracker,
 			iface:       iface,
-			source:      strings.TrimSpace(s.Find("td:nth-child(5)").Text()),
-			destination: strings.TrimSpace(s.Find("td:nth-child(7)").Text()),
-			gateway:     strings.TrimSpace(s.Find("td:nth-child(9)").Text()),
-			description: strings.TrimSpace(s.Find("td:nth-child(12)").Text()),
+			source:      table.text(s, "Source"),
+			destination: table.text(s, "Destination"),
+			protocol:    ruleProtocol(table.text(s, "Protocol")),
+			port:        rulePort(table.text(s, "Port 2")),
+			gateway:     table.text(s, "Gateway"),
+			description: table.text(s, "Description"),
+			family:      protocolFamily(table.text(s, "Protocol")),
 
 			client: client,
-		}
-		rules[i] = rule
+		})
+		return nil
 	})
 
+	return rules, err
+}
+
+func (client *sensemillaClient) ListRules(ctx context.Context, iface string) ([]FirewallRule, error) {
+	doc, err := client.firewallRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	senseRules, err := client.parseRules(doc, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]FirewallRule, len(senseRules))
+	for i, rule := range senseRules {
+		rules[i] = rule
+	}
+
 	return rules, nil
 }
 
+// resolveRule finds the current table position of rule.
+// Positions shift whenever a rule above is added or removed, so the
+// rule is looked up by tracker right before acting on it, and the
+// returned position is only good for the returned document.
+func (client *sensemillaClient) resolveRule(ctx context.Context, rule *sensemillaFirewallRule) (*goquery.Document, string, error) {
+	doc, err := client.firewallRules(ctx, rule.iface)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rules, err := client.parseRules(doc, rule.iface)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, current := range rules {
+		// older firmware without trackers can only be matched by position
+		if rule.tracker != "" && current.tracker != rule.tracker {
+			continue
+		}
+		if rule.tracker == "" && current.id != rule.id {
+			continue
+		}
+
+		if current.source != rule.source || current.description != rule.description {
+			return nil, "", fmt.Errorf("rule %v for iface %v no longer matches source %v and description %q, refusing to change it", rule.identity(), rule.iface, rule.source, rule.description)
+		}
+
+		return doc, current.id, nil
+	}
+
+	return nil, "", fmt.Errorf("rule %v for iface %v no longer exists", rule.identity(), rule.iface)
+}
+
 func (client *sensemillaClient) applyChanges(document *goquery.Document, sendRequest func(req.Param) error) error {
-	form := document.Find(".alert-warning form.pull-right")
+	form := document.Find(client.profile.ApplyForm)
 	if form.Length() <= 0 {
 		return errors.New("unable to find Apply Changes form")
 	}
 
-	csrf, csrfFound := form.Find("input[name=\"__csrf_magic\"]").Attr("value")
+	csrf, csrfFound := form.Find(client.profile.csrfSelector()).Attr("value")
 	if !csrfFound {
 		return errors.New("could not find CSRF input value")
 	}
 
 	return sendRequest(req.Param{
-		"__csrf_magic": csrf,
-		"apply":        "Apply Changes",
+		client.profile.CSRFField:  csrf,
+		client.profile.ApplyField: client.profile.ApplyValue,
 	})
 }
 
-func (client *sensemillaClient) applyChangesFirewallRules(doc *goquery.Document, iface string) error {
+func (client *sensemillaClient) applyChangesFirewallRules(ctx context.Context, doc *goquery.Document, iface string) error {
+	if deferApply(ctx, client, iface) {
+		return nil
+	}
+
 	return client.applyChanges(doc, func(params req.Param) error {
 		ifacePath, err := client.path("/firewall_rules.php")
 		if err != nil {
 			return err
 		}
 
-		result, err := req.Post(ifacePath, req.QueryParam{"if": iface}, params)
+		result, err := client.session.Post(ifacePath, ctx, req.QueryParam{"if": iface}, params)
 		if err != nil {
 			return err
 		}
@@ -269,27 +370,76 @@ func (client *sensemillaClient) applyChangesFirewallRules(doc *goquery.Document,
 	})
 }
 
-func (client *sensemillaClient) AddRule(iface, source, destination, gateway, description string) (FirewallRule, error) {
-	rules, err := client.ListRules(iface)
-	if err != nil {
-		return nil, err
-	}
+// Batch applies the filter once for every interface fn changed
+func (client *sensemillaClient) Batch(ctx context.Context, fn func(ctx context.Context) error) error {
+	return runBatch(ctx, client, fn, func(ctx context.Context, ifaces []string) error {
+		for _, iface := range ifaces {
+			doc, err := client.firewallRules(ctx, iface)
+			if err != nil {
+				return err
+			}
+
+			if err := client.applyChangesFirewallRules(ctx, doc, iface); err != nil {
+				return err
+			}
+		}
 
-	// hacky logic:
-	// shove the new rule after the first rule that has a gateway other than *
-	// should probably switch to using a description dork or something instead...
-	afterID := ""
-	for _, rule := range rules {
-		senseRule, ok := rule.(*sensemillaFirewallRule)
-		if !ok {
-			continue
+		return nil
+	})
+}
+
+// sensemillaAddressParams fills the src or dst fields of the rule form.
+// Aliases are entered like single hosts.
+func sensemillaAddressParams(prefix, address string) req.Param {
+	if address == "*" {
+		return req.Param{
+			prefix + "type": "any",
 		}
+	}
 
-		if senseRule.Gateway() != "*" {
-			break
+	address, mask := splitNetwork(address)
+	if mask != "" {
+		return req.Param{
+			prefix + "type": "network",
+			prefix:          address,
+			prefix + "mask": mask,
 		}
+	}
+
+	return req.Param{
+		prefix + "type": "single",
+		prefix:          address,
+	}
+}
+
+// sensemillaPortParams fills the destination port fields of the rule form
+func sensemillaPortParams(port string) req.Param {
+	if port == "*" {
+		return req.Param{}
+	}
+
+	ports := strings.SplitN(port, "-", 2)
+	return req.Param{
+		"dstbeginport": ports[0],
+		"dstendport":   ports[len(ports)-1],
+	}
+}
+
+func (client *sensemillaClient) AddRule(ctx context.Context, iface, family, source, destination, protocol, port, gateway, description string) (FirewallRule, error) {
+	rules, err := client.ListRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	afterIndex, err := client.placement.insertAfter(rules, RulePrecedence(source, destination, protocol, port))
+	if err != nil {
+		return nil, err
+	}
 
-		afterID = senseRule.id
+	// -1 asks for the top of the table
+	afterID := "-1"
+	if afterIndex >= 0 {
+		afterID = rules[afterIndex].(*sensemillaFirewallRule).id
 	}
 
 	ifacePath, err := client.path("/firewall_rules_edit.php")
@@ -297,8 +447,8 @@ func (client *sensemillaClient) AddRule(iface, source, destination, gateway, des
 		return nil, err
 	}
 
-	doc, err := client.fetchOrLogin(func() (*goquery.Document, error) {
-		result, err := req.Get(ifacePath, req.QueryParam{"if": iface})
+	doc, err := client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		result, err := client.session.Get(ifacePath, ctx, req.QueryParam{"if": iface})
 		if err != nil {
 			return nil, err
 		}
@@ -320,47 +470,27 @@ func (client *sensemillaClient) AddRule(iface, source, destination, gateway, des
 		return nil, err
 	}
 
-	csrf, csrfFound := doc.Find("input[name=\"__csrf_magic\"]").Attr("value")
+	csrf, csrfFound := doc.Find(client.profile.csrfSelector()).Attr("value")
 	if !csrfFound {
 		return nil, errors.New("could not find CSRF input value")
 	}
 
-	var srcParam req.Param
-	var destParam req.Param
-
-	if source == "*" {
-		srcParam = req.Param{
-			"srctype": "any",
-		}
-	} else {
-		srcParam = req.Param{
-			"srctype": "single",
-			"src":     source,
-		}
-	}
-
-	if destination == "*" {
-		destParam = req.Param{
-			"dsttype": "any",
-		}
-	} else {
-		destParam = req.Param{
-			"dsttype": "single",
-			"dst":     destination,
-		}
+	proto := protocol
+	if proto == "*" {
+		proto = "any"
 	}
 
-	result, err := req.Post(ifacePath, srcParam, destParam, req.Param{
-		"__csrf_magic": csrf,
-		"interface":    iface,
-		"descr":        description,
-		"gateway":      gateway,
-		"after":        afterID,
+	result, err := client.session.Post(ifacePath, ctx, sensemillaAddressParams("src", source), sensemillaAddressParams("dst", destination), sensemillaPortParams(port), req.Param{
+		client.profile.CSRFField: csrf,
+		"interface":              iface,
+		"descr":                  description,
+		"gateway":                gateway,
+		"after":                  afterID,
+		"ipprotocol":             family,
+		"proto":                  proto,
 
 		// guff:
 		"type":               "pass",
-		"ipprotocol":         "inet",
-		"proto":              "any",
 		"icmptype[]":         "any",
 		"dscp":               "",
 		"tag":                "",
@@ -383,6 +513,9 @@ func (client *sensemillaClient) AddRule(iface, source, destination, gateway, des
 		"ruleid":             "",
 		"save":               "Save",
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	resp := result.Response()
 	if resp == nil {
@@ -394,23 +527,30 @@ func (client *sensemillaClient) AddRule(iface, source, destination, gateway, des
 		return nil, fmt.Errorf("unexpected status code %d when adding rule for iface %v", resp.StatusCode, iface)
 	}
 
-	doc, err = client.firewallRules(iface)
+	doc, err = client.firewallRules(ctx, iface)
 	if err != nil {
 		return nil, err
 	}
 
-	err = client.applyChangesFirewallRules(doc, iface)
+	err = client.applyChangesFirewallRules(ctx, doc, iface)
 	if err != nil {
 		return nil, err
 	}
 
-	rules, err = client.ListRules(iface)
+	rules, err = client.ListRules(ctx, iface)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, rule := range rules {
-		if rule.Source() == source && rule.Gateway() == gateway && rule.Destination() == destination && rule.Description() == description {
+	for i, rule := range rules {
+		if rule.Source() == source && rule.Gateway() == gateway && rule.Destination() == destination && rule.Protocol() == protocol && rule.Port() == port && rule.Description() == description && rule.Family() == family {
+			if err := client.placement.check(rules, i); err != nil {
+				if deleteErr := rule.Delete(ctx); deleteErr != nil {
+					return nil, fmt.Errorf("%v, and removing it failed: %v", err, deleteErr)
+				}
+				return nil, fmt.Errorf("%v, removed it", err)
+			}
+
 			return rule, nil
 		}
 	}
@@ -418,13 +558,15 @@ func (client *sensemillaClient) AddRule(iface, source, destination, gateway, des
 	return nil, errors.New("unable to find created rule")
 }
 
-func (client *sensemillaClient) deleteRule(iface string, id string) error {
-	doc, err := client.firewallRules(iface)
+func (client *sensemillaClient) deleteRule(ctx context.Context, rule *sensemillaFirewallRule) error {
+	iface := rule.iface
+
+	doc, id, err := client.resolveRule(ctx, rule)
 	if err != nil {
 		return err
 	}
 
-	csrf, csrfFound := doc.Find("input[name=\"__csrf_magic\"]").Attr("value")
+	csrf, csrfFound := doc.Find(client.profile.csrfSelector()).Attr("value")
 	if !csrfFound {
 		return errors.New("could not find CSRF input value")
 	}
@@ -434,11 +576,11 @@ func (client *sensemillaClient) deleteRule(iface string, id string) error {
 		return err
 	}
 
-	result, err := req.Post(ifacePath, req.QueryParam{"if": iface}, req.Param{
-		"__csrf_magic": csrf,
-		"act":          "del",
-		"if":           iface,
-		"id":           id,
+	result, err := client.session.Post(ifacePath, ctx, req.QueryParam{"if": iface}, req.Param{
+		client.profile.CSRFField: csrf,
+		"act":                    "del",
+		"if":                     iface,
+		"id":                     id,
 	})
 	if err != nil {
 		return err
@@ -454,25 +596,668 @@ func (client *sensemillaClient) deleteRule(iface string, id string) error {
 		return fmt.Errorf("unexpected status code %d when deleting rule %v for iface %v", resp.StatusCode, id, iface)
 	}
 
-	doc, err = client.firewallRules(iface)
+	doc, err = client.firewallRules(ctx, iface)
+	if err != nil {
+		return err
+	}
+
+	err = client.applyChangesFirewallRules(ctx, doc, iface)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (client *sensemillaClient) updateRule(ctx context.Context, rule *sensemillaFirewallRule, gateway, description string) (FirewallRule, error) {
+	iface := rule.iface
+
+	_, id, err := client.resolveRule(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	editPath, err := client.path("/firewall_rules_edit.php")
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		result, err := client.session.Get(editPath, ctx, req.QueryParam{"if": iface, "id": id})
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, errors.New("unexpected nil response during updateRule")
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d when visiting edit page of rule %v for iface %v", resp.StatusCode, id, iface)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	form := doc.Find("form:has(input[name=\"descr\"])").First()
+	if form.Length() <= 0 {
+		return nil, errors.New("unable to find edit rule form")
+	}
+
+	// resubmit the form as-is so every other setting of the rule survives
+	values := formValues(form)
+	if values.Get(client.profile.CSRFField) == "" {
+		return nil, errors.New("could not find CSRF input value")
+	}
+
+	values.Set("gateway", gateway)
+	values.Set("descr", description)
+	values.Set("id", id)
+	values.Set("save", "Save")
+
+	result, err := client.session.Post(editPath, ctx, req.QueryParam{"if": iface, "id": id}, values)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return nil, errors.New("unexpected nil response during updateRule")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 302 && resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %d when updating rule %v for iface %v", resp.StatusCode, id, iface)
+	}
+
+	doc, err = client.firewallRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.applyChangesFirewallRules(ctx, doc, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err = client.firewallRules(ctx, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := client.parseRules(doc, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, current := range rules {
+		sameRule := current.tracker == rule.tracker
+		if rule.tracker == "" {
+			sameRule = current.id == id
+		}
+
+		if sameRule && current.gateway == gateway && current.description == description {
+			return current, nil
+		}
+	}
+
+	return nil, errors.New("unable to find updated rule")
+}
+
+func (client *sensemillaClient) aliases(ctx context.Context) (*goquery.Document, error) {
+	return client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		aliasesPath, err := client.path("/firewall_aliases.php")
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := client.session.Get(aliasesPath, ctx, req.QueryParam{"tab": "all"})
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, errors.New("unexpected nil response during ListAliases")
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d when fetching aliases", resp.StatusCode)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
+}
+
+func (client *sensemillaClient) aliasEditPage(ctx context.Context, id string) (*goquery.Document, error) {
+	return client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		editPath, err := client.path("/firewall_aliases_edit.php")
+		if err != nil {
+			return nil, err
+		}
+
+		query := req.QueryParam{"tab": "ip"}
+		if id != "" {
+			query["id"] = id
+		}
+
+		result, err := client.session.Get(editPath, ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, errors.New("unexpected nil response during alias edit")
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d when visiting edit page of alias %v", resp.StatusCode, id)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
+}
+
+// aliasAddresses reads every address from an alias edit page
+func aliasAddresses(doc *goquery.Document) []string {
+	addresses := []string{}
+	doc.Find("input[name^=\"address\"]").Each(func(i int, s *goquery.Selection) {
+		address, _ := s.Attr("value")
+		address = strings.TrimSpace(address)
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	})
+	return addresses
+}
+
+func (client *sensemillaClient) ListAliases(ctx context.Context) ([]Alias, error) {
+	doc, err := client.aliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := newHTMLTable("aliases", doc.Find(client.profile.AliasTable), client.profile.Columns, "Name", "Values", "Description")
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []Alias{}
+
+	err = table.each(func(s *goquery.Selection) error {
+		editLink, found := s.Find("a[href*=\"firewall_aliases_edit.php\"]").Attr("href")
+		if !found {
+			return nil
+		}
+
+		editURL, err := url.Parse(editLink)
+		if err != nil {
+			return err
+		}
+
+		alias := &sensemillaAlias{
+			id:          editURL.Query().Get("id"),
+			name:        table.text(s, "Name"),
+			description: table.text(s, "Description"),
+			addresses:   []string{},
+		}
+
+		values := table.text(s, "Values")
+		if strings.HasSuffix(values, "…") {
+			// only the first few values are listed, the rest need the edit page
+			editDoc, err := client.aliasEditPage(ctx, alias.id)
+			if err != nil {
+				return err
+			}
+
+			alias.addresses = aliasAddresses(editDoc)
+		} else if values != "" {
+			for _, value := range strings.Split(values, ",") {
+				alias.addresses = append(alias.addresses, strings.TrimSpace(value))
+			}
+		}
+
+		aliases = append(aliases, alias)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return aliases, nil
+}
+
+func (client *sensemillaClient) applyChangesAliases(ctx context.Context, doc *goquery.Document) error {
+	return client.applyChanges(doc, func(params req.Param) error {
+		aliasesPath, err := client.path("/firewall_aliases.php")
+		if err != nil {
+			return err
+		}
+
+		result, err := client.session.Post(aliasesPath, ctx, params)
+		if err != nil {
+			return err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return errors.New("unexpected nil response during apply changes")
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("unexpected status code %d when applying alias changes", resp.StatusCode)
+		}
+
+		return nil
+	})
+}
+
+func (client *sensemillaClient) UpdateAlias(ctx context.Context, name, description string, addresses []string) (Alias, error) {
+	aliases, err := client.ListAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id := ""
+	for _, alias := range aliases {
+		if alias.Name() == name {
+			id = alias.(*sensemillaAlias).id
+			break
+		}
+	}
+
+	doc, err := client.aliasEditPage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	form := doc.Find("form:has(input[name=\"name\"])").First()
+	if form.Length() <= 0 {
+		return nil, errors.New("unable to find edit alias form")
+	}
+
+	values := formValues(form)
+	if values.Get(client.profile.CSRFField) == "" {
+		return nil, errors.New("could not find CSRF input value")
+	}
+
+	for key := range values {
+		if strings.HasPrefix(key, "address") || strings.HasPrefix(key, "detail") {
+			values.Del(key)
+		}
+	}
+
+	values.Set("name", name)
+	values.Set("descr", description)
+	values.Set("type", "host")
+	values.Set("tab", "ip")
+	values.Set("save", "Save")
+	if id != "" {
+		values.Set("id", id)
+		values.Set("origname", name)
+	}
+
+	for i, address := range addresses {
+		values.Set("address"+strconv.Itoa(i), address)
+		values.Set("detail"+strconv.Itoa(i), "")
+	}
+
+	editPath, err := client.path("/firewall_aliases_edit.php")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := client.session.Post(editPath, ctx, values)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return nil, errors.New("unexpected nil response during UpdateAlias")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 302 && resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code %d when saving alias %v", resp.StatusCode, name)
+	}
+
+	doc, err = client.aliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.applyChangesAliases(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err = client.ListAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alias := range aliases {
+		if alias.Name() == name {
+			return alias, nil
+		}
+	}
+
+	return nil, errors.New("unable to find saved alias")
+}
+
+func (client *sensemillaClient) neighbourTable(ctx context.Context, path, name, selector, addressColumn string) ([]Neighbour, error) {
+	doc, err := client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		tablePath, err := client.path(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := client.session.Get(tablePath, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, errors.New("unexpected nil response during ListNeighbours")
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d when fetching %v table", resp.StatusCode, name)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := newHTMLTable(name, doc.Find(selector), client.profile.Columns, addressColumn, "MAC address")
+	if err != nil {
+		return nil, err
+	}
+
+	neighbours := []Neighbour{}
+	err = table.each(func(s *goquery.Selection) error {
+		neighbour := Neighbour{
+			// NDP entries carry a zone like "%em0"
+			Address:         strings.SplitN(table.text(s, addressColumn), "%", 2)[0],
+			HardwareAddress: strings.ToLower(table.text(s, "MAC address")),
+		}
+
+		if neighbour.Address != "" && neighbour.HardwareAddress != "" {
+			neighbours = append(neighbours, neighbour)
+		}
+		return nil
+	})
+
+	return neighbours, err
+}
+
+func (client *sensemillaClient) ListNeighbours(ctx context.Context) ([]Neighbour, error) {
+	arp, err := client.neighbourTable(ctx, "/diag_arp.php", "ARP", client.profile.ARPTable, "IP address")
+	if err != nil {
+		return nil, err
+	}
+
+	ndp, err := client.neighbourTable(ctx, "/diag_ndp.php", "NDP", client.profile.NDPTable, "IPv6 address")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(arp, ndp...), nil
+}
+
+// page fetches path, logging in if needed
+func (client *sensemillaClient) page(ctx context.Context, path, operation string) (*goquery.Document, error) {
+	return client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		fullPath, err := client.path(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := client.session.Get(fullPath, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, fmt.Errorf("unexpected nil response during %v", operation)
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d during %v", resp.StatusCode, operation)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
+}
+
+// IsMaster reads the CARP status page: the node is master
+// if any of its virtual IPs is
+func (client *sensemillaClient) IsMaster(ctx context.Context) (bool, error) {
+	doc, err := client.page(ctx, "/status_carp.php", "IsMaster")
+	if err != nil {
+		return false, err
+	}
+
+	table, err := newHTMLTable("CARP", doc.Find(client.profile.CARPTable), client.profile.Columns, "Status")
+	if err != nil {
+		return false, err
+	}
+
+	vips := 0
+	master := false
+	err = table.each(func(s *goquery.Selection) error {
+		status := strings.ToUpper(table.text(s, "Status"))
+		if status == "" {
+			return nil
+		}
+
+		vips++
+		if strings.Contains(status, "MASTER") {
+			master = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if vips == 0 {
+		return false, errors.New("no CARP virtual IPs found")
+	}
+
+	return master, nil
+}
+
+// SyncConfig presses "Force Config Sync" on the filter reload page,
+// which pushes the config to the backup over XMLRPC
+func (client *sensemillaClient) SyncConfig(ctx context.Context) error {
+	doc, err := client.page(ctx, "/status_filter_reload.php", "SyncConfig")
+	if err != nil {
+		return err
+	}
+
+	csrf, csrfFound := doc.Find(client.profile.csrfSelector()).Attr("value")
+	if !csrfFound {
+		return errors.New("could not find CSRF input value")
+	}
+
+	reloadPath, err := client.path("/status_filter_reload.php")
+	if err != nil {
+		return err
+	}
+
+	result, err := client.session.Post(reloadPath, ctx, req.Param{
+		client.profile.CSRFField: csrf,
+		"syncfilter":             "Force Config Sync",
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return errors.New("unexpected nil response during SyncConfig")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status code %d when syncing config", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (client *sensemillaClient) postStates(ctx context.Context, doc *goquery.Document, params req.Param) error {
+	csrf, csrfFound := doc.Find(client.profile.csrfSelector()).Attr("value")
+	if !csrfFound {
+		return errors.New("could not find CSRF input value")
+	}
+	params[client.profile.CSRFField] = csrf
+
+	statesPath, err := client.path("/diag_dump_states.php")
+	if err != nil {
+		return err
+	}
+
+	result, err := client.session.Post(statesPath, ctx, params)
+	if err != nil {
+		return err
+	}
+
+	resp := result.Response()
+	if resp == nil {
+		return errors.New("unexpected nil response during KillStates")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status code %d when killing states", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// KillStates uses the state table page. Without wan it kills every
+// state of source at once, with wan it removes the states of source
+// listed on that interface one by one.
+func (client *sensemillaClient) KillStates(ctx context.Context, source, wan string) error {
+	doc, err := client.fetchOrLogin(ctx, func() (*goquery.Document, error) {
+		statesPath, err := client.path("/diag_dump_states.php")
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := client.session.Get(statesPath, ctx, req.QueryParam{"filter": source})
+		if err != nil {
+			return nil, err
+		}
+
+		resp := result.Response()
+		if resp == nil {
+			return nil, errors.New("unexpected nil response during KillStates")
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("unexpected status code %d when fetching states", resp.StatusCode)
+		}
+
+		return goquery.NewDocumentFromReader(resp.Body)
+	})
 	if err != nil {
 		return err
 	}
 
-	err = client.applyChangesFirewallRules(doc, iface)
+	if wan == "" {
+		return client.postStates(ctx, doc, req.Param{
+			"filter":     source,
+			"killfilter": "Kill States",
+		})
+	}
+
+	table, err := newHTMLTable("states", doc.Find(client.profile.StateTable), client.profile.Columns, "Interface")
 	if err != nil {
 		return err
 	}
 
+	// each row has a remove button for its "source|destination" pair
+	entries := []string{}
+	table.each(func(s *goquery.Selection) error {
+		if !strings.EqualFold(table.text(s, "Interface"), wan) {
+			return nil
+		}
+
+		if entry, found := s.Find("[data-entry]").Attr("data-entry"); found {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	for _, entry := range entries {
+		addresses := strings.SplitN(entry, "|", 2)
+		if len(addresses) != 2 {
+			continue
+		}
+
+		err = client.postStates(ctx, doc, req.Param{
+			"action": "remove",
+			"srcip":  addresses[0],
+			"dstip":  addresses[1],
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *sensemillaClient) SetPlacement(placement Placement) error {
+	if err := placement.Validate(); err != nil {
+		return err
+	}
+
+	client.placement = placement
 	return nil
 }
 
 // NewSensemillaClient returns a new remote.Client compatible with
-// Sensemilla-ish Web UI
-func NewSensemillaClient(host, username, password string) Client {
+// Sensemilla-ish Web UI, with its own HTTP session
+// and the given profiles tried before the default one
+func NewSensemillaClient(host, username, password string, options SessionOptions, profiles []SensemillaProfile) (Client, error) {
+	session, err := newSession(options)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles = append(append([]SensemillaProfile{}, profiles...), defaultSensemillaProfile)
+
 	return &sensemillaClient{
 		host,
 		username,
 		password,
-	}
+
+		session,
+		DefaultPlacement,
+
+		profiles,
+		selectSensemillaProfile(profiles, ""),
+		"",
+	}, nil
 }
@@ -0,0 +1,20 @@
+package remote
+
+type sensemillaAlias struct {
+	id          string
+	name        string
+	description string
+	addresses   []string
+}
+
+func (alias *sensemillaAlias) Name() string {
+	return alias.name
+}
+
+func (alias *sensemillaAlias) Description() string {
+	return alias.description
+}
+
+func (alias *sensemillaAlias) Addresses() []string {
+	return alias.addresses
+}
@@ -1,24 +1,51 @@
 package remote
 
+import "context"
+
 type sensemillaFirewallRule struct {
-	id          string
+	id          string // position in the rule table, changes when rules above move
+	tracker     string // stable ID, empty on firmware that does not show it
 	iface       string
 	source      string
 	destination string
+	protocol    string
+	port        string
 	gateway     string
 	description string
+	family      string
 
 	client *sensemillaClient
 }
 
+// identity names the rule in error messages
+func (rule *sensemillaFirewallRule) identity() string {
+	if rule.tracker != "" {
+		return "with tracker " + rule.tracker
+	}
+
+	return "at position " + rule.id
+}
+
 func (rule *sensemillaFirewallRule) Source() string {
 	return rule.source
 }
 
+func (rule *sensemillaFirewallRule) Family() string {
+	return rule.family
+}
+
 func (rule *sensemillaFirewallRule) Destination() string {
 	return rule.destination
 }
 
+func (rule *sensemillaFirewallRule) Protocol() string {
+	return rule.protocol
+}
+
+func (rule *sensemillaFirewallRule) Port() string {
+	return rule.port
+}
+
 func (rule *sensemillaFirewallRule) Gateway() string {
 	return rule.gateway
 }
@@ -27,6 +54,10 @@ func (rule *sensemillaFirewallRule) Description() string {
 	return rule.description
 }
 
-func (rule *sensemillaFirewallRule) Delete() error {
-	return rule.client.deleteRule(rule.iface, rule.id)
+func (rule *sensemillaFirewallRule) Delete(ctx context.Context) error {
+	return rule.client.deleteRule(ctx, rule)
+}
+
+func (rule *sensemillaFirewallRule) Update(ctx context.Context, gateway, description string) (FirewallRule, error) {
+	return rule.client.updateRule(ctx, rule, gateway, description)
 }
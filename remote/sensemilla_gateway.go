@@ -1,14 +1,15 @@
 package remote
 
+import "time"
+
 type sensemillaGateway struct {
 	name        string
 	gateway     string // ip?
 	monitor     string
-	rtt         string
-	rttsd       string
-	loss        string
-	status      string
-	online      bool
+	rtt         time.Duration
+	rttsd       time.Duration
+	loss        float64
+	status      GatewayStatus
 	description string
 }
 
@@ -24,10 +25,22 @@ func (gateway *sensemillaGateway) GatewayAddress() string {
 	return gateway.gateway
 }
 
-func (gateway *sensemillaGateway) RoundtripTime() string {
+func (gateway *sensemillaGateway) MonitorAddress() string {
+	return gateway.monitor
+}
+
+func (gateway *sensemillaGateway) RoundtripTime() time.Duration {
 	return gateway.rtt
 }
 
-func (gateway *sensemillaGateway) Online() bool {
-	return gateway.online
+func (gateway *sensemillaGateway) RoundtripTimeDeviation() time.Duration {
+	return gateway.rttsd
+}
+
+func (gateway *sensemillaGateway) PacketLoss() float64 {
+	return gateway.loss
+}
+
+func (gateway *sensemillaGateway) Status() GatewayStatus {
+	return gateway.status
 }
@@ -0,0 +1,153 @@
+package remote
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// SensemillaProfile holds the selectors and form fields that move
+// around between firmware versions of the Sensemilla-ish Web UI.
+// Empty fields fall back to the default profile.
+type SensemillaProfile struct {
+	// Version is matched as a prefix of the detected firmware version,
+	// the longest match wins. An empty Version matches anything.
+	Version string `json:"version"`
+
+	LoginForm     string `json:"login_form"`
+	UsernameField string `json:"username_field"`
+	PasswordField string `json:"password_field"`
+	LoginField    string `json:"login_field"`
+	LoginValue    string `json:"login_value"`
+
+	CSRFField string `json:"csrf_field"`
+
+	GatewayTable string `json:"gateway_table"`
+	RuleTable    string `json:"rule_table"`
+	AliasTable   string `json:"alias_table"`
+	ARPTable     string `json:"arp_table"`
+	NDPTable     string `json:"ndp_table"`
+	CARPTable    string `json:"carp_table"`
+	StateTable   string `json:"state_table"`
+
+	ApplyForm  string `json:"apply_form"`
+	ApplyField string `json:"apply_field"`
+	ApplyValue string `json:"apply_value"`
+
+	// Columns renames table headers, keyed by the header the
+	// default profile expects, e.g. {"RTTsd": "RTT stddev"}
+	Columns map[string]string `json:"columns"`
+}
+
+// defaultSensemillaProfile is the markup of every firmware version we
+// know. Detecting the version only picks a different profile when an
+// override file has one for it.
+var defaultSensemillaProfile = SensemillaProfile{
+	LoginForm:     "form.login",
+	UsernameField: "usernamefld",
+	PasswordField: "passwordfld",
+	LoginField:    "login",
+	LoginValue:    "Sign In",
+
+	CSRFField: "__csrf_magic",
+
+	GatewayTable: ".table-responsive .table",
+	RuleTable:    "#ruletable",
+	AliasTable:   ".table-responsive .table",
+	ARPTable:     ".table-responsive .table",
+	NDPTable:     ".table-responsive .table",
+	CARPTable:    ".table-responsive .table",
+	StateTable:   ".table-responsive .table",
+
+	ApplyForm:  ".alert-warning form.pull-right",
+	ApplyField: "apply",
+	ApplyValue: "Apply Changes",
+}
+
+// LoadSensemillaProfiles reads a JSON list of profiles from path.
+// They are checked before the default profile.
+func LoadSensemillaProfiles(path string) ([]SensemillaProfile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	profiles := []SensemillaProfile{}
+	if err := json.NewDecoder(file).Decode(&profiles); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+func (profile SensemillaProfile) withDefaults() SensemillaProfile {
+	fallback := func(value *string, defaultValue string) {
+		if *value == "" {
+			*value = defaultValue
+		}
+	}
+
+	defaults := defaultSensemillaProfile
+	fallback(&profile.LoginForm, defaults.LoginForm)
+	fallback(&profile.UsernameField, defaults.UsernameField)
+	fallback(&profile.PasswordField, defaults.PasswordField)
+	fallback(&profile.LoginField, defaults.LoginField)
+	fallback(&profile.LoginValue, defaults.LoginValue)
+	fallback(&profile.CSRFField, defaults.CSRFField)
+	fallback(&profile.GatewayTable, defaults.GatewayTable)
+	fallback(&profile.RuleTable, defaults.RuleTable)
+	fallback(&profile.AliasTable, defaults.AliasTable)
+	fallback(&profile.ARPTable, defaults.ARPTable)
+	fallback(&profile.NDPTable, defaults.NDPTable)
+	fallback(&profile.CARPTable, defaults.CARPTable)
+	fallback(&profile.StateTable, defaults.StateTable)
+	fallback(&profile.ApplyForm, defaults.ApplyForm)
+	fallback(&profile.ApplyField, defaults.ApplyField)
+	fallback(&profile.ApplyValue, defaults.ApplyValue)
+
+	return profile
+}
+
+func (profile SensemillaProfile) csrfSelector() string {
+	return "input[name=\"" + profile.CSRFField + "\"]"
+}
+
+// selectSensemillaProfile picks the profile with the longest
+// version prefix matching version. Earlier profiles win ties.
+func selectSensemillaProfile(profiles []SensemillaProfile, version string) SensemillaProfile {
+	selected := defaultSensemillaProfile
+	matched := -1
+
+	for _, profile := range profiles {
+		if !strings.HasPrefix(version, profile.Version) || len(profile.Version) <= matched {
+			continue
+		}
+
+		selected = profile.withDefaults()
+		matched = len(profile.Version)
+	}
+
+	return selected
+}
+
+var sensemillaVersionPattern = regexp.MustCompile(`\d+\.\d+(\.\d+)?(-[A-Za-z]+)?(-p\d+)?`)
+
+// detectSensemillaVersion reads the firmware version from the
+// System Information widget of the dashboard shown after login
+func detectSensemillaVersion(document *goquery.Document) string {
+	version := ""
+	document.Find("th").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if normalizeHeader(s.Text()) != "version" {
+			return true
+		}
+
+		version = sensemillaVersionPattern.FindString(s.Next().Text())
+		return version == ""
+	})
+
+	return version
+}
@@ -0,0 +1,108 @@
+package remote
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/imroc/req"
+)
+
+// SessionOptions configure the HTTP session owned by a client.
+// Every client gets its own cookie jar and connection pool, so
+// several clients can talk to different firewalls in one process.
+type SessionOptions struct {
+	// Timeout limits a single HTTP request, 0 means no limit
+	Timeout time.Duration
+
+	// IdleTimeout closes keep-alive connections after this long,
+	// 0 means no limit
+	IdleTimeout time.Duration
+
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+
+	// Proxy is the URL of an HTTP proxy to use.
+	// When empty, the usual proxy environment variables are used.
+	Proxy string
+
+	// InsecureTLS skips certificate verification,
+	// for firewalls that use self-signed certificates
+	InsecureTLS bool
+
+	// Debug logs every request and response
+	Debug bool
+}
+
+// debugTransport logs requests and responses passing through it
+type debugTransport struct {
+	transport http.RoundTripper
+}
+
+func (transport *debugTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if dump, err := httputil.DumpRequestOut(request, true); err == nil {
+		log.Printf("remote request:\n%s", dump)
+	}
+
+	response, err := transport.transport.RoundTrip(request)
+	if err != nil {
+		log.Println("remote request failed:", err)
+		return nil, err
+	}
+
+	if dump, err := httputil.DumpResponse(response, true); err == nil {
+		log.Printf("remote response:\n%s", dump)
+	}
+
+	return response, nil
+}
+
+func newSession(options SessionOptions) (*req.Req, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       options.IdleTimeout,
+		DisableKeepAlives:     options.DisableKeepAlives,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: options.InsecureTLS,
+		},
+	}
+
+	if options.Proxy != "" {
+		proxy, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if options.Debug {
+		roundTripper = &debugTransport{transport}
+	}
+
+	session := req.New()
+	session.SetClient(&http.Client{
+		Jar:       jar,
+		Transport: roundTripper,
+		Timeout:   options.Timeout,
+	})
+
+	return session, nil
+}
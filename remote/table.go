@@ -0,0 +1,142 @@
+package remote
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// htmlTable finds cells by the text of their column header, so columns
+// added by other firmware versions or packages do not shift what we read
+type htmlTable struct {
+	name    string
+	rows    *goquery.Selection
+	columns map[string]int
+
+	// renames maps the headers callers ask for to the ones on the page
+	renames map[string]string
+}
+
+func normalizeHeader(header string) string {
+	return strings.ToLower(strings.Join(strings.Fields(header), " "))
+}
+
+func colspan(cell *goquery.Selection) int {
+	span, err := strconv.Atoi(cell.AttrOr("colspan", "1"))
+	if err != nil || span < 1 {
+		return 1
+	}
+	return span
+}
+
+// newHTMLTable reads the headers of table and fails if any of
+// the required columns is missing
+func newHTMLTable(name string, table *goquery.Selection, renames map[string]string, required ...string) (*htmlTable, error) {
+	if table.Length() <= 0 {
+		return nil, fmt.Errorf("unable to find %v table", name)
+	}
+	table = table.First()
+
+	headerRow := table.Find("thead tr").First()
+	if headerRow.Length() <= 0 {
+		headerRow = table.Find("tr:has(th)").First()
+	}
+
+	parsed := &htmlTable{
+		name:    name,
+		rows:    table.ChildrenFiltered("tbody").ChildrenFiltered("tr").NotSelection(headerRow),
+		columns: map[string]int{},
+		renames: renames,
+	}
+
+	position := 0
+	headerRow.Find("th, td").Each(func(i int, s *goquery.Selection) {
+		header := normalizeHeader(s.Text())
+
+		// repeated headers are numbered: the destination port
+		// follows the source port as "Port 2"
+		name := header
+		for n := 2; ; n++ {
+			if _, found := parsed.columns[name]; !found {
+				break
+			}
+			name = header + " " + strconv.Itoa(n)
+		}
+
+		if header != "" {
+			parsed.columns[name] = position
+		}
+		position += colspan(s)
+	})
+
+	for _, column := range required {
+		if _, found := parsed.index(column); !found {
+			return nil, fmt.Errorf("%v table has no %q column", name, parsed.header(column))
+		}
+	}
+
+	return parsed, nil
+}
+
+func (table *htmlTable) header(column string) string {
+	if renamed, found := table.renames[column]; found {
+		return renamed
+	}
+	return column
+}
+
+func (table *htmlTable) index(column string) (int, bool) {
+	index, found := table.columns[normalizeHeader(table.header(column))]
+	return index, found
+}
+
+// skip reports whether row holds no data of its own:
+// separators, disabled entries and "nothing here" placeholders
+func (table *htmlTable) skip(row *goquery.Selection) bool {
+	if row.HasClass("separator") || row.HasClass("disabled") {
+		return true
+	}
+
+	cells := row.ChildrenFiltered("td")
+	return cells.Length() == 1 && colspan(cells) > 1
+}
+
+// cell returns the cell of row under column, which is empty
+// if the table or the row has no such column
+func (table *htmlTable) cell(row *goquery.Selection, column string) *goquery.Selection {
+	index, found := table.index(column)
+	if !found {
+		return row.ChildrenFiltered("td").Slice(0, 0)
+	}
+
+	position := 0
+	cells := row.ChildrenFiltered("td")
+	for i := range cells.Nodes {
+		cell := cells.Eq(i)
+		if position == index {
+			return cell
+		}
+		position += colspan(cell)
+	}
+
+	return cells.Slice(0, 0)
+}
+
+func (table *htmlTable) text(row *goquery.Selection, column string) string {
+	return strings.TrimSpace(table.cell(row, column).Text())
+}
+
+// each calls fn for every data row, stopping at the first error
+func (table *htmlTable) each(fn func(row *goquery.Selection) error) error {
+	var err error
+	table.rows.EachWithBreak(func(i int, row *goquery.Selection) bool {
+		if table.skip(row) {
+			return true
+		}
+		err = fn(row)
+		return err == nil
+	})
+	return err
+}
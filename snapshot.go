@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// snapshot caches what page views read from the remote: gateway status
+// and the rules of each interface, kept fresh by runPoller.
+// Writes bump the generation of the rules they change, and rules
+// listed before a bump are not stored, so a read that was overtaken
+// by a write can never bring back what the write changed.
+var snapshot = struct {
+	lock sync.Mutex
+
+	gateways        []remote.Gateway
+	gatewaysUpdated time.Time
+
+	rules           map[string][]remote.FirewallRule
+	rulesUpdated    map[string]time.Time
+	rulesGeneration map[string]int
+}{
+	rules:           map[string][]remote.FirewallRule{},
+	rulesUpdated:    map[string]time.Time{},
+	rulesGeneration: map[string]int{},
+}
+
+func snapshotEnabled() bool {
+	return cfg.PollInterval > 0
+}
+
+// cachedGatewayStatus is getGatewayStatus served from the snapshot,
+// along with when it was taken
+func cachedGatewayStatus(ctx context.Context) ([]remote.Gateway, time.Time, error) {
+	if snapshotEnabled() {
+		snapshot.lock.Lock()
+		gateways, updated := snapshot.gateways, snapshot.gatewaysUpdated
+		snapshot.lock.Unlock()
+		if !updated.IsZero() {
+			return gateways, updated, nil
+		}
+	}
+
+	var gateways []remote.Gateway
+	var updated time.Time
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		gateways, updated, err = refreshGatewayStatus(ctx, readClient)
+		return err
+	})
+
+	return gateways, updated, err
+}
+
+func refreshGatewayStatus(ctx context.Context, readClient remote.Client) ([]remote.Gateway, time.Time, error) {
+	gateways, err := readClient.ListGateways(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	updated := time.Now()
+
+	if snapshotEnabled() {
+		snapshot.lock.Lock()
+		snapshot.gateways, snapshot.gatewaysUpdated = gateways, updated
+		snapshot.lock.Unlock()
+	}
+
+	return gateways, updated, nil
+}
+
+// cachedRules lists the rules of iface from the snapshot, along with
+// when they were listed. They must only be read: changes go through
+// rules listed while holding the state lock.
+func cachedRules(ctx context.Context, iface string) ([]remote.FirewallRule, time.Time, error) {
+	if snapshotEnabled() {
+		snapshot.lock.Lock()
+		rules, updated := snapshot.rules[iface], snapshot.rulesUpdated[iface]
+		snapshot.lock.Unlock()
+		if !updated.IsZero() {
+			return rules, updated, nil
+		}
+	}
+
+	var rules []remote.FirewallRule
+	var updated time.Time
+	err := withReadClient(ctx, func(ctx context.Context, readClient remote.Client) (err error) {
+		rules, updated, err = refreshRules(ctx, readClient, iface)
+		return err
+	})
+
+	return rules, updated, err
+}
+
+func refreshRules(ctx context.Context, readClient remote.Client, iface string) ([]remote.FirewallRule, time.Time, error) {
+	snapshot.lock.Lock()
+	generation := snapshot.rulesGeneration[iface]
+	snapshot.lock.Unlock()
+
+	rules, err := readClient.ListRules(ctx, iface)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	updated := time.Now()
+
+	if snapshotEnabled() {
+		snapshot.lock.Lock()
+		if snapshot.rulesGeneration[iface] == generation {
+			snapshot.rules[iface], snapshot.rulesUpdated[iface] = rules, updated
+		}
+		snapshot.lock.Unlock()
+	}
+
+	return rules, updated, nil
+}
+
+// invalidateRules drops the cached rules of iface after a write,
+// so the next read lists them again
+func invalidateRules(iface string) {
+	snapshot.lock.Lock()
+	delete(snapshot.rules, iface)
+	delete(snapshot.rulesUpdated, iface)
+	snapshot.rulesGeneration[iface]++
+	snapshot.lock.Unlock()
+}
+
+// refreshSnapshot lists gateway status and the rules of every interface
+func refreshSnapshot(ctx context.Context) error {
+	return withReadClient(ctx, func(ctx context.Context, readClient remote.Client) error {
+		if _, _, err := refreshGatewayStatus(ctx, readClient); err != nil {
+			return err
+		}
+
+		for _, iface := range interfaceNames() {
+			if _, _, err := refreshRules(ctx, readClient, iface); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// runPoller refreshes the snapshot every interval until ctx is done
+func runPoller(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := refreshSnapshot(ctx); err != nil {
+			log.Println("error refreshing snapshot", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+)
+
+// writeChange is a queued choice of gw for the traffic from source's
+// host to dest, or the removal of that choice if gw is nil
+type writeChange struct {
+	iface  string
+	source string
+	// sources are the addresses of source's host, looked up on queueing
+	sources []string
+	dest    destination
+	gw      *gateway
+	until   time.Time
+	// family, if set, limits the change to the rules of that family,
+	// like reverting a single time-limited rule does
+	family string
+}
+
+// key identifies what a change decides, later changes
+// with the same key replace it while it waits
+func (change writeChange) key() string {
+	return change.iface + "|" + change.source + "|" + change.dest.Name + "|" + change.family
+}
+
+// touches reports whether change is about the rules of family
+func (change writeChange) touches(family string) bool {
+	return change.family == "" || change.family == family
+}
+
+const (
+	jobQueued    = "queued"
+	jobDeleting  = "deleting"
+	jobAdding    = "adding"
+	jobApplying  = "applying"
+	jobVerifying = "verifying"
+	jobDone      = "done"
+	jobFailed    = "failed"
+)
+
+// writeJob is the handle on a queued change. A job whose change was
+// replaced by a later one before it ran shares the later one's fate.
+type writeJob struct {
+	ID string
+
+	// key is the key of the change, to find it in the queue
+	key  string
+	done chan struct{}
+
+	lock       sync.Mutex
+	state      string
+	err        error
+	finishedAt time.Time
+	waiters    int
+	// abandoned is set once everyone waiting on the job gave up
+	abandoned bool
+}
+
+func newWriteJob() *writeJob {
+	job := &writeJob{
+		ID:    newJobID(),
+		done:  make(chan struct{}),
+		state: jobQueued,
+	}
+	registerJob(job)
+
+	return job
+}
+
+// Wait blocks until the job finished and returns its error.
+// Once the last waiter gives up on ctx, the change is dropped if it
+// is still queued and no job on it is followed otherwise.
+func (job *writeJob) Wait(ctx context.Context) error {
+	job.lock.Lock()
+	job.waiters++
+	job.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		job.lock.Lock()
+		job.waiters--
+		if job.waiters == 0 && job.finishedAt.IsZero() {
+			job.abandoned = true
+		}
+		abandoned := job.abandoned
+		job.lock.Unlock()
+
+		if abandoned {
+			dropAbandonedWrite(job.key, ctx.Err())
+		}
+		return ctx.Err()
+	case <-job.done:
+	}
+
+	job.lock.Lock()
+	job.waiters--
+	job.lock.Unlock()
+
+	_, err := job.Status()
+	return err
+}
+
+// Status returns the state of the job and, once it failed, why
+func (job *writeJob) Status() (string, error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return job.state, job.err
+}
+
+func (job *writeJob) setState(state string) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	job.state = state
+}
+
+func (job *writeJob) finish(err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	job.state, job.err, job.finishedAt = jobDone, err, time.Now()
+	if err != nil {
+		job.state = jobFailed
+	}
+	close(job.done)
+}
+
+// progressKey marks a context with the jobs of the change made through it
+type progressKey struct{}
+
+// reportProgress moves the jobs of the change made through ctx,
+// if any, to state
+func reportProgress(ctx context.Context, state string) {
+	jobs, _ := ctx.Value(progressKey{}).([]*writeJob)
+	for _, job := range jobs {
+		job.setState(state)
+	}
+}
+
+// pendingWrite is the latest change for a key and every job waiting on it
+type pendingWrite struct {
+	change writeChange
+	jobs   []*writeJob
+}
+
+// writeQueue holds changes until runWriteQueue applies them.
+// It keeps the latest change per key only, so clicking twice or
+// several people clicking at once costs one batch, not one each.
+var writeQueue = struct {
+	lock    sync.Mutex
+	pending map[string]*pendingWrite
+	order   []string
+	wake    chan struct{}
+}{
+	pending: map[string]*pendingWrite{},
+	wake:    make(chan struct{}, 1),
+}
+
+// maxWriteBatch limits how many changes share one batch,
+// each gets the remote timeout
+const maxWriteBatch = 20
+
+func queueWrite(change writeChange) *writeJob {
+	job := newWriteJob()
+	job.key = change.key()
+
+	writeQueue.lock.Lock()
+	if pending, found := writeQueue.pending[change.key()]; found {
+		pending.change = change
+		pending.jobs = append(pending.jobs, job)
+	} else {
+		writeQueue.pending[change.key()] = &pendingWrite{change, []*writeJob{job}}
+		writeQueue.order = append(writeQueue.order, change.key())
+	}
+	writeQueue.lock.Unlock()
+
+	select {
+	case writeQueue.wake <- struct{}{}:
+	default:
+	}
+
+	return job
+}
+
+// dropAbandonedWrite removes the change for key from the queue if it
+// is still there and every job on it was abandoned, failing them with err.
+// Jobs nobody waits on, like those the API returned right away, keep
+// their change queued.
+func dropAbandonedWrite(key string, err error) {
+	writeQueue.lock.Lock()
+	pending, found := writeQueue.pending[key]
+	if !found {
+		writeQueue.lock.Unlock()
+		return
+	}
+
+	for _, job := range pending.jobs {
+		job.lock.Lock()
+		abandoned := job.abandoned
+		job.lock.Unlock()
+
+		if !abandoned {
+			writeQueue.lock.Unlock()
+			return
+		}
+	}
+
+	delete(writeQueue.pending, key)
+	for i, queued := range writeQueue.order {
+		if queued == key {
+			writeQueue.order = append(writeQueue.order[:i], writeQueue.order[i+1:]...)
+			break
+		}
+	}
+	writeQueue.lock.Unlock()
+
+	for _, job := range pending.jobs {
+		job.finish(err)
+	}
+}
+
+// takeWrites removes up to maxWriteBatch changes from the queue,
+// oldest first
+func takeWrites() []*pendingWrite {
+	writeQueue.lock.Lock()
+	defer writeQueue.lock.Unlock()
+
+	count := len(writeQueue.order)
+	if count > maxWriteBatch {
+		count = maxWriteBatch
+	}
+
+	writes := make([]*pendingWrite, count)
+	for i, key := range writeQueue.order[:count] {
+		writes[i] = writeQueue.pending[key]
+		delete(writeQueue.pending, key)
+	}
+	writeQueue.order = writeQueue.order[count:]
+
+	// more to do than fits a batch
+	if len(writeQueue.order) > 0 {
+		select {
+		case writeQueue.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return writes
+}
+
+// applyWrites makes the changes of writes in one batch, so remotes
+// that can apply their filter once for all of them do
+func applyWrites(ctx context.Context, writes []*pendingWrite) {
+	errs := make([]error, len(writes))
+	resets := make([][]stateReset, len(writes))
+	undos := make([][]func(ctx context.Context) error, len(writes))
+	batchClient, batched := client.(remote.BatchClient)
+	batch := func(ctx context.Context) error {
+		for i, write := range writes {
+			ctx := context.WithValue(ctx, progressKey{}, write.jobs)
+			ctx = context.WithValue(ctx, stateResetsKey{}, &resets[i])
+			ctx = context.WithValue(ctx, rollbackKey{}, &undos[i])
+			if write.change.gw == nil {
+				errs[i] = applyRemovalLocked(ctx, write.change)
+			} else {
+				errs[i] = applyChoiceLocked(ctx, write.change)
+			}
+		}
+
+		// remotes without batches apply every change as it is made,
+		// there is nothing left to wait for
+		if !batched {
+			return nil
+		}
+
+		for i, write := range writes {
+			if errs[i] == nil {
+				reportProgress(context.WithValue(ctx, progressKey{}, write.jobs), jobApplying)
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel, err := lockStateFor(ctx, cfg.RemoteTimeout*time.Duration(len(writes)))
+	if err == nil {
+		if batched {
+			err = batchClient.Batch(ctx, batch)
+		} else {
+			err = batch(ctx)
+		}
+		if err != nil {
+			log.Println("error applying", len(writes), "changes", err)
+			rollbackWrites(ctx, errs, undos, err)
+		}
+
+		for i, write := range writes {
+			if errs[i] == nil {
+				for _, reset := range resets[i] {
+					resetStates(ctx, reset.source, reset.previousGateway, reset.gateway)
+				}
+
+				reportProgress(context.WithValue(ctx, progressKey{}, write.jobs), jobVerifying)
+				errs[i] = verifyChangeLocked(ctx, write.change)
+			}
+		}
+
+		cancel()
+		unlockState()
+	}
+
+	for i, write := range writes {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+
+		for _, job := range write.jobs {
+			job.finish(errs[i])
+		}
+	}
+}
+
+// rollbackWrites undoes the changes that were made in a batch which
+// then failed to apply with err, in a batch of their own, and fails
+// them with err. Changes that failed by themselves were already undone.
+func rollbackWrites(ctx context.Context, errs []error, undos [][]func(ctx context.Context) error, err error) {
+	rollbackErrs := make([]error, len(errs))
+	rollback := func(ctx context.Context) error {
+		for i := range errs {
+			if errs[i] != nil {
+				continue
+			}
+
+			for j := len(undos[i]) - 1; j >= 0 && rollbackErrs[i] == nil; j-- {
+				rollbackErrs[i] = undos[i][j](ctx)
+			}
+		}
+		return nil
+	}
+
+	// ctx may have run out, that must not stop the rollback
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.RemoteTimeout*time.Duration(len(errs)))
+	defer cancel()
+
+	var applyErr error
+	if batchClient, ok := client.(remote.BatchClient); ok {
+		applyErr = batchClient.Batch(ctx, rollback)
+	} else {
+		applyErr = rollback(ctx)
+	}
+	if applyErr != nil {
+		log.Println("error applying the rollback of", len(errs), "changes", applyErr)
+	}
+
+	for i := range errs {
+		if errs[i] != nil {
+			continue
+		}
+
+		if rollbackErrs[i] == nil {
+			rollbackErrs[i] = applyErr
+		}
+		errs[i] = &switchError{err, rollbackErrs[i]}
+	}
+}
+
+// verifyChangeLocked reads back whether change took effect.
+// The caller must hold the state lock.
+func verifyChangeLocked(ctx context.Context, change writeChange) error {
+	if cfg.Mode == modeAlias {
+		aliasClient, err := getAliasClient()
+		if err != nil {
+			return err
+		}
+
+		aliases, err := aliasClient.ListAliases(ctx)
+		if err != nil {
+			return err
+		}
+
+		alias := sourceAlias(aliases, change.sources[0])
+		if change.gw == nil && alias != nil {
+			return fmt.Errorf("verifying failed: %v is still in alias %v", change.source, alias.Name())
+		}
+		if change.gw != nil && (alias == nil || alias.Name() != aliasName(change.gw.Name)) {
+			return fmt.Errorf("verifying failed: %v is not in the alias of %v", change.source, change.gw.Name)
+		}
+
+		return nil
+	}
+
+	rules, err := client.ListRules(ctx, change.iface)
+	if err != nil {
+		return err
+	}
+
+	if change.gw == nil {
+		for _, rule := range rules {
+			if strings.HasPrefix(rule.Description(), dork) && containsSource(change.sources, rule.Source()) && change.dest.matches(rule) && change.touches(rule.Family()) {
+				return fmt.Errorf("verifying failed: a rule for %v to %v is left", rule.Source(), change.dest.Label)
+			}
+		}
+
+		return nil
+	}
+
+	for _, address := range change.sources {
+		for _, target := range choiceTargets(address, change.dest, *change.gw) {
+			if target.gateway == "" || !change.touches(target.family) {
+				continue
+			}
+
+			var found remote.FirewallRule
+			for _, rule := range rules {
+				if rule.Source() == address && rule.Family() == target.family && change.dest.matches(rule) && strings.HasPrefix(rule.Description(), dork) {
+					found = rule
+					break
+				}
+			}
+
+			if found == nil {
+				return fmt.Errorf("verifying failed: no %v rule for %v to %v", target.family, address, change.dest.Label)
+			}
+			if found.Gateway() != target.gateway {
+				return fmt.Errorf("verifying failed: %v goes to %v through %v", address, change.dest.Label, found.Gateway())
+			}
+		}
+	}
+
+	return nil
+}
+
+// runWriteQueue applies queued changes until ctx is done.
+// Changes queued while a batch runs make up the next one.
+func runWriteQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-writeQueue.wake:
+		}
+
+		if writes := takeWrites(); len(writes) > 0 {
+			applyWrites(ctx, writes)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote"
+	"github.com/AlbinoDrought/creamy-gateway-picker/remote/remotetest"
+)
+
+// useTestRemote points the picker at an in-memory remote offering
+// the gateways VPN and WAN on lan, until the test ends
+func useTestRemote(tb testing.TB, requestLatency, applyLatency time.Duration) *remotetest.Client {
+	tb.Helper()
+
+	previousClient, previousCfg := client, cfg
+	tb.Cleanup(func() {
+		client, cfg = previousClient, previousCfg
+	})
+
+	testRemote := remotetest.NewClient([]string{"VPN", "WAN"}, requestLatency, applyLatency)
+	client = testRemote
+
+	cfg.Mode = modeRule
+	cfg.RemoteTimeout = time.Minute
+	cfg.Gateways = []gateway{
+		{Name: "VPN", Label: "VPN"},
+		{Name: "WAN", Label: "WAN"},
+	}
+	cfg.Interfaces = []networkInterface{{Name: "lan", Gateways: cfg.Gateways}}
+
+	return testRemote
+}
+
+// testChanges switches count hosts on lan to gw
+func testChanges(count int, gw gateway) []writeChange {
+	changes := make([]writeChange, count)
+	for i := range changes {
+		source := fmt.Sprintf("10.0.0.%d", i+2)
+		changes[i] = writeChange{
+			iface:   "lan",
+			source:  source,
+			sources: []string{source},
+			dest:    catchAll,
+			gw:      &gw,
+		}
+	}
+
+	return changes
+}
+
+func TestApplyWritesRollsBackFailedBatch(t *testing.T) {
+	testRemote := useTestRemote(t, 0, 0)
+	ctx := context.Background()
+
+	job := newWriteJob()
+	applyWrites(ctx, []*pendingWrite{{testChanges(1, cfg.Gateways[0])[0], []*writeJob{job}}})
+	if err := job.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	testRemote.FailApplies = 1
+	writes := []*pendingWrite{}
+	for _, change := range testChanges(2, cfg.Gateways[1]) {
+		writes = append(writes, &pendingWrite{change, []*writeJob{newWriteJob()}})
+	}
+	applyWrites(ctx, writes)
+
+	for _, write := range writes {
+		err := write.jobs[0].Wait(ctx)
+		if err == nil || !strings.Contains(err.Error(), "the previous rule was restored") {
+			t.Errorf("switching %v: expected a rolled back failure, got %v", write.change.source, err)
+		}
+	}
+
+	rules, err := testRemote.ListRules(ctx, "lan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Source() != "10.0.0.2" || rules[0].Gateway() != "VPN" {
+		for _, rule := range rules {
+			t.Log(rule.Source(), rule.Gateway())
+		}
+		t.Fatal("expected only the rule sending 10.0.0.2 through VPN to be left")
+	}
+}
+
+func TestWaitDropsAbandonedChange(t *testing.T) {
+	useTestRemote(t, 0, 0)
+	t.Cleanup(func() { takeWrites() })
+
+	changes := testChanges(2, cfg.Gateways[0])
+	waited := queueWrite(changes[0])
+	async := queueWrite(changes[1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waited.Wait(ctx); err != context.Canceled {
+		t.Fatalf("expected the wait to be canceled, got %v", err)
+	}
+
+	if state, err := waited.Status(); state != jobFailed || err != context.Canceled {
+		t.Errorf("expected the abandoned job to fail as canceled, got %v %v", state, err)
+	}
+	if !waited.status().Abandoned {
+		t.Error("expected the job status to tell it was abandoned")
+	}
+
+	writes := takeWrites()
+	if len(writes) != 1 || writes[0].jobs[0] != async {
+		t.Fatalf("expected only the change nobody waited on to be left queued, got %v changes", len(writes))
+	}
+}
+
+func TestVerifyChangeChecksEveryFamily(t *testing.T) {
+	testRemote := useTestRemote(t, 0, 0)
+	ctx := context.Background()
+
+	gw := gateway{Name: "VPN", Name6: "VPN6", Label: "VPN"}
+	change := writeChange{
+		iface:   "lan",
+		source:  "10.0.0.2",
+		sources: []string{"10.0.0.2", "fd00::2"},
+		dest:    catchAll,
+		gw:      &gw,
+	}
+
+	_, err := testRemote.AddRule(ctx, "lan", remote.AddressFamily("10.0.0.2"), "10.0.0.2", "*", "*", "*", "VPN", dork+" user chose \"VPN\" (VPN)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChangeLocked(ctx, change); err == nil {
+		t.Fatal("expected verifying to fail without a rule for fd00::2")
+	}
+
+	_, err = testRemote.AddRule(ctx, "lan", remote.AddressFamily("fd00::2"), "fd00::2", "*", "*", "*", "VPN6", dork+" user chose \"VPN\" (VPN6)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyChangeLocked(ctx, change); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkWriteQueue switches 20 hosts per op, once applying every
+// change on its own like before the queue, once through the queue
+func BenchmarkWriteQueue(b *testing.B) {
+	const hosts = 20
+
+	b.Run("serialized", func(b *testing.B) {
+		testRemote := useTestRemote(b, time.Millisecond, 20*time.Millisecond)
+		ctx := context.Background()
+
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			for _, change := range testChanges(hosts, cfg.Gateways[n%2]) {
+				job := newWriteJob()
+				applyWrites(ctx, []*pendingWrite{{change, []*writeJob{job}}})
+				if err := job.Wait(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(testRemote.Applies())/float64(b.N), "applies/op")
+	})
+
+	b.Run("coalesced", func(b *testing.B) {
+		testRemote := useTestRemote(b, time.Millisecond, 20*time.Millisecond)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runWriteQueue(ctx)
+
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			queued := []*writeJob{}
+			for _, change := range testChanges(hosts, cfg.Gateways[n%2]) {
+				queued = append(queued, queueWrite(change))
+			}
+
+			for _, job := range queued {
+				if err := job.Wait(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(testRemote.Applies())/float64(b.N), "applies/op")
+	})
+}